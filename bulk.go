@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Directions of a bulk transfer, chosen with -bulk
+const (
+	BulkUpload   = "up"
+	BulkDownload = "down"
+	BulkEcho     = "echo"
+)
+
+// maxPayloadSize is the largest payload a message may carry
+const maxPayloadSize = 64 << 20
+
+// defaultBulkSize is the payload size of bulk messages when -d is not given
+const defaultBulkSize = 1 << 20
+
+var (
+	bulkFillerMu sync.Mutex
+	bulkFiller   string
+)
+
+// bulkPayload returns n bytes of random content. The content is generated
+// once and shared, so a multi-megabyte message costs no more than a copy.
+func bulkPayload(n int) string {
+	bulkFillerMu.Lock()
+	defer bulkFillerMu.Unlock()
+
+	if len(bulkFiller) < n {
+		bulkFiller = generateRandomString(n)
+	}
+	return bulkFiller[:n]
+}
+
+// BulkStats collects the bytes moved by a bulk transfer and how long each
+// message took to send and to receive. It is safe for concurrent use.
+type BulkStats struct {
+	mu        sync.Mutex
+	direction string
+	size      int
+	start     time.Time
+	messages  int64
+	sentBytes int64
+	recvBytes int64
+	send      *Histogram
+	receive   *Histogram
+}
+
+// NewBulkStats creates empty statistics for a transfer in the given
+// direction, starting now
+func NewBulkStats(direction string, size int) *BulkStats {
+	return &BulkStats{
+		direction: direction,
+		size:      size,
+		start:     time.Now(),
+		send:      NewHistogram(),
+		receive:   NewHistogram(),
+	}
+}
+
+// Record adds one completed message: the bytes of the request and the reply,
+// how long writing the request took and how long the reply took to arrive
+// from its first to its last byte
+func (b *BulkStats) Record(sentBytes, recvBytes int, send, receive time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.messages++
+	b.sentBytes += int64(sentBytes)
+	b.recvBytes += int64(recvBytes)
+	b.send.Record(send)
+	b.receive.Record(receive)
+}
+
+// BulkSummary is a snapshot of the bulk transfer statistics. Byte counts
+// are whole WebSocket messages, including the message envelope.
+type BulkSummary struct {
+	Direction string
+	Size      int
+	Messages  int64
+	Elapsed   time.Duration
+	SentBytes int64
+	RecvBytes int64
+	// Transfer holds the send and receive time distributions per message
+	Transfer []PhaseSummary
+}
+
+// rate returns bytes per second over the transfer
+func (s BulkSummary) rate(bytes int64) float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / s.Elapsed.Seconds()
+}
+
+// UploadRate returns the bytes sent per second
+func (s BulkSummary) UploadRate() float64 {
+	return s.rate(s.SentBytes)
+}
+
+// DownloadRate returns the bytes received per second
+func (s BulkSummary) DownloadRate() float64 {
+	return s.rate(s.RecvBytes)
+}
+
+// EchoRate returns the payload bytes that made the round trip per second
+func (s BulkSummary) EchoRate() float64 {
+	if s.Direction != BulkEcho {
+		return 0
+	}
+	return s.rate(s.Messages * int64(s.Size))
+}
+
+// Summary returns a snapshot of the statistics collected so far
+func (b *BulkStats) Summary() *BulkSummary {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	summary := &BulkSummary{
+		Direction: b.direction,
+		Size:      b.size,
+		Messages:  b.messages,
+		Elapsed:   time.Since(b.start),
+		SentBytes: b.sentBytes,
+		RecvBytes: b.recvBytes,
+	}
+	if b.messages > 0 {
+		summary.Transfer = []PhaseSummary{
+			newPhaseSummary("send", b.send),
+			newPhaseSummary("receive", b.receive),
+		}
+	}
+	return summary
+}
+
+// runBulk moves large messages back to back over every connection until the
+// run is stopped, recording their RTT in stats and the bandwidth achieved in
+// the returned summary
+func (r *clientRun) runBulk(stats *RTTStats) (Summary, error) {
+	conns := make([]*websocket.Conn, 0, r.config.Connections)
+	for i := 0; i < r.config.Connections; i++ {
+		conn, _, err := r.dialConn(i)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			r.dashboard.SetState("connection failed")
+			return Summary{}, fmt.Errorf("failed to connect to server: %v", err)
+		}
+		conns = append(conns, conn)
+		r.logger.Write(fmt.Sprintf("%sConnected to WebSocket server (%s -> %s) at: %s%s",
+			connLabel(r.target.Name, i, r.config.Connections > 1),
+			conn.LocalAddr(), conn.RemoteAddr(), r.url, subprotocolNote(conn)))
+	}
+
+	// Stop sending once the run duration is over
+	var deadline <-chan time.Time
+	if r.config.Duration > 0 {
+		durationTimer := time.NewTimer(r.config.Duration)
+		defer durationTimer.Stop()
+		deadline = durationTimer.C
+	}
+
+	r.logger.Write(fmt.Sprintf("Bulk %s of %d byte messages on %d connection(s)",
+		r.config.Bulk, r.config.PayloadSize, len(conns)))
+	r.dashboard.SetState(fmt.Sprintf("bulk %s", r.config.Bulk))
+
+	bulk := NewBulkStats(r.config.Bulk, r.config.PayloadSize)
+	control := newRunControl()
+	interrupt := r.interrupt
+	finished := make(chan error, len(conns))
+	for i, conn := range conns {
+		go func(id int, conn *websocket.Conn) {
+			finished <- r.bulk(id, conn, control, stats, bulk)
+		}(i, conn)
+	}
+
+	var runErr error
+	for running := len(conns); running > 0; {
+		select {
+		case err := <-finished:
+			running--
+			if err != nil && runErr == nil {
+				runErr = err
+			}
+
+		case <-r.reportTick:
+			if report, ok := stats.TakeWindow(); ok {
+				r.results.WriteInterval(report)
+			}
+
+		case <-deadline:
+			deadline = nil
+			r.logger.Write(fmt.Sprintf("Run duration of %s reached", r.config.Duration))
+			r.dashboard.SetState("draining")
+			control.Drain()
+
+		case <-interrupt:
+			interrupt = nil
+			r.aborted = true
+			r.dashboard.SetState("closing")
+			control.Abort()
+			// Unblock transfers in progress
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}
+	}
+
+	summary := stats.Summary()
+	summary.Setup = r.setup.Summary()
+	summary.Bulk = bulk.Summary()
+	return summary, runErr
+}
+
+// bulk sends messages one after the other on one connection, each as soon
+// as the reply to the previous one has arrived, until the run is stopped or
+// the configured number of messages is done
+func (r *clientRun) bulk(id int, conn *websocket.Conn, control *runControl, stats *RTTStats, bulk *BulkStats) error {
+	defer conn.Close()
+	label := connLabel(r.target.Name, id, r.config.Connections > 1)
+
+	snowflake, err := NewSnowflake((r.nodeBase + int64(id)) % 1024)
+	if err != nil {
+		return fmt.Errorf("failed to create snowflake generator: %v", err)
+	}
+
+	// A failed transfer after an abort is the abort, not an error
+	stopped := func(err error) error {
+		select {
+		case <-control.abort:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	warned := false
+	for seq := uint64(1); r.config.Count == 0 || seq <= r.config.Count; seq++ {
+		select {
+		case <-control.drain:
+			return nil
+		case <-control.abort:
+			return nil
+		default:
+		}
+
+		snowflakeID, err := snowflake.NextID()
+		if err != nil {
+			return fmt.Errorf("failed to generate snowflake ID: %v", err)
+		}
+		msg := Message{
+			Timestamp: time.Now().UTC(),
+			MessageID: fmt.Sprintf("%d", snowflakeID),
+			Seq:       seq,
+			Bulk:      r.config.Bulk,
+		}
+		if r.config.Bulk == BulkDownload {
+			msg.Size = r.config.PayloadSize
+		} else {
+			msg.Content = generatePayload(r.config.PayloadSize, r.config.Compressibility, bulkPayload)
+		}
+		frameType, request, err := encodeMessage(msg, r.config.Encoding)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %v", err)
+		}
+
+		sendStart := time.Now()
+		if err := conn.WriteMessage(frameType, request); err != nil {
+			return stopped(fmt.Errorf("write: %v", err))
+		}
+		sendDone := time.Now()
+		stats.RecordSent()
+
+		// The reply is timed from its first byte to its last
+		conn.SetReadDeadline(sendDone.Add(r.config.Timeout))
+		messageType, reader, err := conn.NextReader()
+		if err != nil {
+			stats.RecordLost(1)
+			return stopped(fmt.Errorf("read: %v", err))
+		}
+		recvStart := time.Now()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			stats.RecordLost(1)
+			return stopped(fmt.Errorf("read: %v", err))
+		}
+		now := time.Now()
+
+		reply, err := decodeMessage(messageType, data)
+		if err != nil {
+			return fmt.Errorf("failed to parse reply: %v", err)
+		}
+		if reply.MessageID != msg.MessageID {
+			return fmt.Errorf("unexpected reply (ID: %s) while waiting for %s", reply.MessageID, msg.MessageID)
+		}
+		if r.config.Bulk == BulkDownload && len(reply.Content) != r.config.PayloadSize && !warned {
+			warned = true
+			r.logger.Write(fmt.Sprintf("%sServer sent %d bytes instead of %d, it may not support bulk downloads",
+				label, len(reply.Content), r.config.PayloadSize))
+		}
+
+		rtt := now.Sub(sendStart)
+		stats.Record(r.target.Name, id, rtt)
+		bulk.Record(len(request), len(data), sendDone.Sub(sendStart), now.Sub(recvStart))
+		if r.compression != nil {
+			r.compression.RecordWrite(len(request), sendDone.Sub(sendStart))
+			r.compression.RecordRead(len(data), now.Sub(recvStart))
+		}
+		r.results.WriteSample(Sample{
+			Target:       r.target.Name,
+			ConnID:       id,
+			MessageID:    msg.MessageID,
+			Seq:          seq,
+			SendTime:     sendStart,
+			RecvTime:     now,
+			RTT:          rtt,
+			PayloadSize:  max(len(msg.Content), len(reply.Content)),
+			SendTransfer: sendDone.Sub(sendStart),
+			RecvTransfer: now.Sub(recvStart),
+		})
+	}
+
+	// Close politely, without waiting for the server to finish the handshake
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return nil
+}
+
+// printBulkSummary writes the bandwidth achieved by a bulk transfer and the
+// transfer time distributions of its messages
+func printBulkSummary(w io.Writer, bulk *BulkSummary) {
+	fmt.Fprintf(w, "\nBulk transfer (%s, %d byte messages): %d message(s) in %s\n",
+		bulk.Direction, bulk.Size, bulk.Messages, bulk.Elapsed.Truncate(time.Millisecond))
+	fmt.Fprintf(w, "    Upload = %s (%d bytes), Download = %s (%d bytes)\n",
+		formatThroughput(bulk.UploadRate()), bulk.SentBytes,
+		formatThroughput(bulk.DownloadRate()), bulk.RecvBytes)
+	if bulk.Direction == BulkEcho {
+		fmt.Fprintf(w, "    Echo = %s of payload round tripped\n", formatThroughput(bulk.EchoRate()))
+	}
+	if len(bulk.Transfer) > 0 {
+		printPhaseTable(w, "Transfer", bulk.Transfer)
+	}
+}
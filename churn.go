@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runChurn repeatedly dials, upgrades, exchanges one echo and closes, on
+// every connection slot in parallel, until the run is stopped. The echoes
+// are recorded in stats and the set up timings in the returned summary.
+func (r *clientRun) runChurn(stats *RTTStats) (Summary, error) {
+	setup := r.setup
+	control := newRunControl()
+
+	// Dials in progress are cancelled when the run is interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop dialing once the run duration is over
+	var deadline <-chan time.Time
+	if r.config.Duration > 0 {
+		durationTimer := time.NewTimer(r.config.Duration)
+		defer durationTimer.Stop()
+		deadline = durationTimer.C
+	}
+
+	r.logger.Write(fmt.Sprintf("Churning %d connection(s) to: %s", r.config.Connections, r.url))
+	r.dashboard.SetState("churning")
+
+	interrupt := r.interrupt
+	finished := make(chan struct{}, r.config.Connections)
+	for i := 0; i < r.config.Connections; i++ {
+		go func(id int) {
+			r.churn(ctx, id, control, stats, setup)
+			finished <- struct{}{}
+		}(i)
+	}
+
+	for running := r.config.Connections; running > 0; {
+		select {
+		case <-finished:
+			running--
+
+		case <-r.reportTick:
+			if report, ok := stats.TakeWindow(); ok {
+				r.results.WriteInterval(report)
+			}
+
+		case <-deadline:
+			deadline = nil
+			r.logger.Write(fmt.Sprintf("Run duration of %s reached", r.config.Duration))
+			r.dashboard.SetState("draining")
+			control.Drain()
+
+		case <-interrupt:
+			interrupt = nil
+			r.aborted = true
+			r.dashboard.SetState("closing")
+			control.Abort()
+			cancel()
+		}
+	}
+
+	summary := stats.Summary()
+	summary.Setup = setup.Summary()
+	return summary, nil
+}
+
+// churn runs connection cycles on one slot until the run is stopped or the
+// configured number of cycles is done, pausing -interval between cycles
+func (r *clientRun) churn(ctx context.Context, id int, control *runControl, stats *RTTStats, setup *SetupStats) {
+	label := connLabel(r.target.Name, id, r.config.Connections > 1)
+
+	snowflake, err := NewSnowflake((r.nodeBase + int64(id)) % 1024)
+	if err != nil {
+		r.logger.Write(fmt.Sprintf("%sFailed to create snowflake generator: %v", label, err))
+		return
+	}
+
+	for cycle := uint64(1); r.config.Count == 0 || cycle <= r.config.Count; cycle++ {
+		select {
+		case <-control.drain:
+			return
+		case <-control.abort:
+			return
+		default:
+		}
+
+		timing, failedPhase, err := r.churnOnce(ctx, id, cycle, snowflake, stats)
+		if ctx.Err() != nil {
+			// Interrupted, this attempt says nothing about the server
+			return
+		}
+		setup.Record(timing, failedPhase)
+		if err != nil {
+			r.logger.Write(fmt.Sprintf("%sConnection %d failed during %s: %v", label, cycle, failedPhase, err))
+		}
+
+		select {
+		case <-time.After(time.Duration(r.config.Interval) * time.Millisecond):
+		case <-control.drain:
+			return
+		case <-control.abort:
+			return
+		}
+	}
+}
+
+// churnOnce dials a new connection, exchanges one echo over it and closes it.
+// On failure it returns the phase that failed along with the error.
+func (r *clientRun) churnOnce(ctx context.Context, id int, cycle uint64, snowflake *Snowflake,
+	stats *RTTStats) (SetupTiming, string, error) {
+	trace, traceCtx := newSetupTrace(ctx)
+	conn, resp, err := r.dialer.DialContext(traceCtx, r.url, r.header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (HTTP %s)", err, resp.Status)
+		}
+		return trace.timing(), trace.failedPhase(), err
+	}
+	defer conn.Close()
+	if err := r.checkSubprotocol(conn); err != nil {
+		return trace.timing(), PhaseUpgrade, err
+	}
+	trace.finish()
+	r.applyCompression(conn, resp)
+
+	snowflakeID, err := snowflake.NextID()
+	if err != nil {
+		return trace.timing(), PhaseFirstEcho, fmt.Errorf("failed to generate snowflake ID: %v", err)
+	}
+	msg := Message{
+		Timestamp: time.Now().UTC(),
+		Content:   generatePayload(r.config.PayloadSize, r.config.Compressibility, generateRandomString),
+		MessageID: fmt.Sprintf("%d", snowflakeID),
+		// Each connection sends one message, numbered by its cycle so the
+		// server and the samples see the same sequence
+		Seq: cycle,
+	}
+	frameType, data, err := encodeMessage(msg, r.config.Encoding)
+	if err != nil {
+		return trace.timing(), PhaseFirstEcho, fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	if err := conn.WriteMessage(frameType, data); err != nil {
+		return trace.timing(), PhaseFirstEcho, fmt.Errorf("write: %v", err)
+	}
+	stats.RecordSent()
+
+	// Wait for the echo, skipping anything else the server sends
+	conn.SetReadDeadline(time.Now().Add(r.config.Timeout))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			stats.RecordLost(1)
+			return trace.timing(), PhaseFirstEcho, fmt.Errorf("read: %v", err)
+		}
+		if echo, err := decodeMessage(messageType, data); err == nil && echo.MessageID == msg.MessageID {
+			break
+		}
+	}
+	now := time.Now().UTC()
+	rtt := now.Sub(msg.Timestamp)
+
+	stats.Record(r.target.Name, id, rtt)
+	r.results.WriteSample(Sample{
+		Target:      r.target.Name,
+		ConnID:      id,
+		MessageID:   msg.MessageID,
+		Seq:         msg.Seq,
+		SendTime:    msg.Timestamp,
+		RecvTime:    now,
+		RTT:         rtt,
+		PayloadSize: len(msg.Content),
+	})
+
+	timing := trace.timing()
+	timing.FirstEcho = rtt
+
+	// Close politely, without waiting for the server to finish the handshake
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	return timing, "", nil
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,7 +20,7 @@ import (
 )
 
 // generateRandomString creates a random string of specified length
-func generateRandomString(length uint16) string {
+func generateRandomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, length)
 	for i := range b {
@@ -43,253 +47,531 @@ func setupSSLKeyLogger(keyLogFile string) (func(string), error) {
 	}, nil
 }
 
-func startClient(config Config) error {
-	logger := NewBufferedLogger(4096, 250*time.Millisecond)
+func startClient(config Config) (err error) {
+	// Keep stdout clean for structured output
+	var logOutput io.Writer = os.Stdout
+	if config.OutputFormat != OutputText {
+		logOutput = os.Stderr
+	}
+
+	// The dashboard takes over the terminal, including the log lines
+	var dashboard *Dashboard
+	if config.TUI {
+		dashboard = NewDashboard(os.Stdout)
+		logOutput = dashboard
+	}
+
+	logger := NewBufferedLogger(logOutput, 4096, 250*time.Millisecond)
 	defer logger.Stop()
 
+	var results ResultWriter
+	if dashboard != nil {
+		results = dashboard
+	} else {
+		results, err = NewResultWriter(config, os.Stdout, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Stream raw samples to the record file next to the regular output
+	if config.RecordFile != "" {
+		recorder, err := NewSampleRecorder(config.RecordFile, config.RecordFormat, config)
+		if err != nil {
+			return err
+		}
+		results = teeResultWriter{results, recorder}
+		logger.Write(fmt.Sprintf("Recording samples to: %s (%s)", config.RecordFile, config.RecordFormat))
+	}
+	defer func() {
+		if err := results.Close(); err != nil {
+			logger.Write(fmt.Sprintf("Error closing results: %v", err))
+		}
+	}()
+
 	// Initialize random number generator
 	rand.Seed(time.Now().UnixNano())
 
-	// Create a Snowflake ID generator
-	// Using a random node ID between 0-1023
-	nodeID := rand.Int63n(1024)
-	snowflake, err := NewSnowflake(nodeID)
-	if err != nil {
-		return fmt.Errorf("failed to create snowflake generator: %v", err)
+	targets := config.targets()
+
+	// Configure SSL key logging if requested, shared by every target
+	var keyLogWriter io.Writer
+	if config.SSLKeyLogFile != "" && anyTLS(targets) {
+		keyLogger, err := setupSSLKeyLogger(config.SSLKeyLogFile)
+		if err != nil {
+			return err
+		}
+		if keyLogger != nil {
+			keyLogWriter = &KeyLogWriter{keyLogger: keyLogger}
+			logger.Write(fmt.Sprintf("TLS key logging enabled to: %s", config.SSLKeyLogFile))
+		}
 	}
 
-	logger.Write(fmt.Sprintf("Initialized Snowflake ID generator with node ID: %d", nodeID))
+	// Statistics for RTT measurements, aggregated over all connections
+	stats := NewRTTStats()
+	if config.ReportInterval > 0 {
+		stats.EnableWindow()
+	}
+	dashboard.Attach(stats)
 
-	// Configure WebSocket
-	dialer := websocket.DefaultDialer
-	dialer.HandshakeTimeout = 10 * time.Second
+	// What compression saves and costs, over all connections
+	var compression *CompressionStats
+	if config.Compress {
+		compression = NewCompressionStats(config.CompressLevel)
+	}
 
-	if config.UseTLS {
-		// Set up TLS configuration
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: config.InsecureSkipVerify,
+	// Channel for signal handling, closing interrupt stops every target
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt) // Catch SIGINT (Ctrl+C)
+	defer signal.Stop(signals)
+	interrupt := make(chan struct{})
+	stopSignals := make(chan struct{})
+	defer close(stopSignals)
+	go func() {
+		select {
+		case <-signals:
+			close(interrupt)
+		case <-stopSignals:
 		}
+	}()
 
-		// Configure SSL key logging if requested
-		if config.SSLKeyLogFile != "" {
-			keyLogger, err := setupSSLKeyLogger(config.SSLKeyLogFile)
-			if err != nil {
-				return err
+	// Print windowed statistics periodically
+	var reportTick <-chan time.Time
+	if config.ReportInterval > 0 {
+		reportTicker := time.NewTicker(config.ReportInterval)
+		defer reportTicker.Stop()
+		reportTick = reportTicker.C
+	}
+
+	// Each connection gets its own Snowflake node ID so message IDs stay
+	// unique across connections. Start from a random node ID between 0-1023.
+	nodeBase := rand.Int63n(1024)
+	runs := make([]*clientRun, len(targets))
+	for i, target := range targets {
+		proxy, err := targetProxy(config.Proxy, target)
+		if err != nil {
+			return err
+		}
+		if proxy != nil {
+			logger.Write(fmt.Sprintf("%sDialing through %s proxy %s", connLabel(target.Name, 0, false),
+				proxy.Scheme, proxy.Redacted()))
+		}
+
+		runs[i] = &clientRun{
+			config:      config,
+			target:      target,
+			dialer:      newDialer(target, keyLogWriter, config.Subprotocols, proxy, compression),
+			url:         target.URL(),
+			header:      newHeader(target.Headers),
+			logger:      logger,
+			results:     results,
+			setup:       NewSetupStats(),
+			compression: compression,
+			nodeBase:    (nodeBase + int64(i*config.Connections)) % 1024,
+			started:     time.Now(),
+			interrupt:   interrupt,
+		}
+	}
+	// The dashboard shows the first target
+	runs[0].dashboard = dashboard
+
+	var summary Summary
+	var runErr error
+	if len(runs) > 1 {
+		summary, runErr = runTargets(runs, stats, reportTick)
+	} else if run := runs[0]; config.Churn {
+		run.reportTick = reportTick
+		summary, runErr = run.runChurn(stats)
+	} else if config.Bulk != "" {
+		run.reportTick = reportTick
+		summary, runErr = run.runBulk(stats)
+		if summary.Bulk == nil {
+			// The connections could not be opened
+			return runErr
+		}
+	} else if len(config.PayloadSweep) > 0 {
+		run.reportTick = reportTick
+		summary, runErr = run.runSweep(stats)
+		if summary.Sizes == nil {
+			// Not even the first size could connect
+			return runErr
+		}
+	} else if len(config.Profile) > 0 {
+		run.reportTick = reportTick
+		summary, runErr = run.runProfile(stats)
+		if summary.Steps == nil {
+			// Not even the first step could connect
+			return runErr
+		}
+	} else {
+		run.reportTick = reportTick
+
+		// Connect to the WebSocket server
+		load := LoadStep{Rate: config.Rate, Connections: config.Connections}
+		probes, err := run.dial(load, stats)
+		if err != nil {
+			return err
+		}
+		if config.Rate > 0 {
+			logger.Write(fmt.Sprintf("Sending %g messages per second on a fixed schedule", config.Rate))
+		}
+		if config.Window > 1 {
+			logger.Write(fmt.Sprintf("Keeping up to %d messages in flight on each connection", config.Window))
+		}
+		runErr = run.runProbes(probes, config.Duration, stats)
+
+		summary = stats.Summary()
+		summary.Setup = run.setup.Summary()
+		summary.Disconnects = run.Disconnects()
+		for _, p := range probes {
+			connSummary := p.Summary()
+			summary.InFlight += connSummary.Summary.InFlight
+			if config.PerConnection {
+				summary.Connections = append(summary.Connections, connSummary)
 			}
-			if keyLogger != nil {
-				tlsConfig.KeyLogWriter = &KeyLogWriter{keyLogger: keyLogger}
-				logger.Write(fmt.Sprintf("TLS key logging enabled to: %s", config.SSLKeyLogFile))
+		}
+	}
+
+	if compression != nil {
+		summary.Compression = compression.Summary()
+	}
+
+	// Ensure we flush the log buffer
+	logger.Flush()
+
+	// Report the last, partial window before the cumulative summary
+	if report, ok := stats.TakeWindow(); ok && report.Summary.Sent+report.Summary.Count > 0 {
+		results.WriteInterval(report)
+	}
+
+	// display stats before exiting
+	results.WriteSummary(summary)
+
+	// Check the final statistics against the thresholds. The verdict is
+	// printed even when the run failed, but the run error decides the exit code.
+	var thresholdErr error
+	if config.Thresholds.Enabled() {
+		thresholdErr = checkThresholds(logOutput, config.Thresholds, summary)
+	}
+	if runErr != nil {
+		return runErr
+	}
+	return thresholdErr
+}
+
+// anyTLS reports whether any of the targets uses TLS
+func anyTLS(targets []Target) bool {
+	for _, target := range targets {
+		if target.UseTLS {
+			return true
+		}
+	}
+	return false
+}
+
+// newDialer creates the WebSocket dialer for a target. With a proxy set, it
+// tunnels through the proxy. With compression set, it offers
+// permessage-deflate and counts the bytes through the socket.
+func newDialer(target Target, keyLogWriter io.Writer, subprotocols []string, proxy *url.URL,
+	compression *CompressionStats) *websocket.Dialer {
+	// Configure WebSocket
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = 10 * time.Second
+	dialer.Subprotocols = subprotocols
+	// Resolve and connect through the set up trace. The proxy is dialed
+	// here rather than by the dialer so the trace can time it.
+	dial := setupDialContext
+	if proxy != nil {
+		dial = proxyDialContext(proxy, nil, dial)
+	}
+	dialer.Proxy = nil
+	dialer.NetDialContext = dial
+	if compression != nil {
+		dialer.EnableCompression = true
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
 			}
+			return &countingConn{Conn: conn, stats: compression}, nil
+		}
+	}
+
+	if target.UseTLS {
+		// Set up TLS configuration
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: target.InsecureSkipVerify,
+			KeyLogWriter:       keyLogWriter,
 		}
 
 		// Configure SNI if server name is not empty
-		if config.ServerName != "" {
-			tlsConfig.ServerName = config.ServerName
+		if target.ServerName != "" {
+			tlsConfig.ServerName = target.ServerName
 		}
 
 		dialer.TLSClientConfig = tlsConfig
 	}
 
-	// Construct WebSocket URL with appropriate scheme
-	scheme := "ws"
-	if config.UseTLS {
-		scheme = "wss"
-	}
-	url := fmt.Sprintf("%s://%s", scheme, config.Addr)
+	return &dialer
+}
 
-	// Prepare request headers
+// newHeader prepares the request headers
+func newHeader(headers map[string]string) http.Header {
 	header := http.Header{}
-	for name, value := range config.Headers {
+	for name, value := range headers {
 		header.Set(name, value)
 	}
+	return header
+}
 
-	// Connect to the WebSocket server
-	conn, _, err := dialer.Dial(url, header)
-	if err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
-	}
-	defer conn.Close()
-
-	logger.Write(
-		fmt.Sprintf("Connected to WebSocket server (%s -> %s) at: %s",
-			conn.LocalAddr(), conn.RemoteAddr(),
-			url,
-		),
-	)
-
-	// Channel to signal when to exit
-	done := make(chan struct{})
-	// Channel to coordinate message sending after receiving response
-	sendNext := make(chan struct{}, 1)
-	// Channel for signal handling
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt) // Catch SIGINT (Ctrl+C)
-
-	// Statistics for RTT measurements
-	var stats struct {
-		sync.Mutex
-		messageCount int
-		totalRTT     time.Duration
-		minRTT       time.Duration
-		maxRTT       time.Duration
-	}
-	stats.minRTT = time.Duration(1<<63 - 1) // Initialize to max possible duration
-	stats.maxRTT = time.Duration(-1 << 63)  // Initialize to min possible duration
-
-	// Set up a goroutine to read messages from the server
-	go func() {
-		defer func() {
-			// Ensure we flush the log buffer
-			logger.Flush()
-
-			// display stats before exiting
-			stats.Lock()
-			defer stats.Unlock()
+// clientRun holds what the connections to one target of a client run share
+type clientRun struct {
+	config    Config
+	target    Target
+	dialer    *websocket.Dialer
+	url       string
+	header    http.Header
+	logger    *BufferedLogger
+	results   ResultWriter
+	dashboard *Dashboard
+	setup     *SetupStats
+	// compression is nil unless -compress is set
+	compression *CompressionStats
+	nodeBase    int64
+	started     time.Time
+
+	// interrupt is closed when the run is interrupted
+	interrupt  <-chan struct{}
+	reportTick <-chan time.Time
+	// aborted is set once the run was interrupted
+	aborted bool
+
+	// Connections that dropped, with -reconnect
+	mu          sync.Mutex
+	disconnects []DisconnectEvent
+}
 
-			if stats.messageCount == 0 {
-				fmt.Println("\nNo messages were exchanged. Exiting...")
-				return
+// dial opens the connections of a load step. Their statistics are recorded
+// in children of stats.
+func (r *clientRun) dial(load LoadStep, stats *RTTStats) ([]*probeConnection, error) {
+	config := r.config
+	config.Rate = load.Rate
+	config.Connections = load.Connections
+
+	probes := make([]*probeConnection, 0, load.Connections)
+	for i := 0; i < load.Connections; i++ {
+		conn, _, err := r.dialConn(i)
+		if err != nil {
+			for _, p := range probes {
+				p.conn.Close()
 			}
+			r.dashboard.SetState("connection failed")
+			return nil, fmt.Errorf("failed to connect to server: %v", err)
+		}
 
-			// Calculate average
-			avgRTT := stats.totalRTT / time.Duration(stats.messageCount)
-
-			// Display ping-style statistics
-			fmt.Printf("\nApproximate round trip times in micro-seconds:\n")
-			fmt.Printf("    Minimum = %dus, Maximum = %dus, Average = %dus\n",
-				stats.minRTT.Microseconds(),
-				stats.maxRTT.Microseconds(),
-				avgRTT.Microseconds(),
-			)
-			fmt.Printf("Messages count: %d\n", stats.messageCount)
-			close(done)
-		}()
-
-		for {
-			messageType, serverMessage, err := conn.ReadMessage()
-			if err != nil {
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-					return
-				}
-				logger.Write(fmt.Sprintf("Error reading message: %v", err))
-				return
+		nodeID := (r.nodeBase + int64(i)) % 1024
+		p, err := newProbeConnection(i, nodeID, conn, config, r.target.Name, r.logger, r.results, stats)
+		if err != nil {
+			conn.Close()
+			for _, p := range probes {
+				p.conn.Close()
 			}
+			return nil, err
+		}
+		p.setup = r.setup
+		p.compression = r.compression
+		probes = append(probes, p)
+
+		r.logger.Write(
+			fmt.Sprintf("%sConnected to WebSocket server (%s -> %s) at: %s, Snowflake node ID: %d%s",
+				p.label,
+				conn.LocalAddr(), conn.RemoteAddr(),
+				r.url, nodeID, subprotocolNote(conn),
+			),
+		)
 
-			switch messageType {
-			case websocket.TextMessage:
-				var msg Message
-				if err := json.Unmarshal(serverMessage, &msg); err != nil {
-					logger.Write(fmt.Sprintf("Error parsing message: %v", err))
-					continue
-				}
+	}
+	r.dashboard.SetState(fmt.Sprintf("connected (%d connection(s))", len(probes)))
 
-				// Calculate round-trip time with nanosecond precision
-				now := time.Now().UTC()
-				rtt := now.Sub(msg.Timestamp)
+	return probes, nil
+}
 
-				// Update statistics
-				stats.Lock()
-				stats.messageCount++
-				stats.totalRTT += rtt
-				if rtt < stats.minRTT {
-					stats.minRTT = rtt
-				}
-				if rtt > stats.maxRTT {
-					stats.maxRTT = rtt
-				}
-				stats.Unlock()
+// dialConn opens the connection of the given slot and records how long its
+// set up took. The response is returned for failed upgrades too.
+func (r *clientRun) dialConn(id int) (*websocket.Conn, *http.Response, error) {
+	trace, ctx := newSetupTrace(context.Background())
+	conn, resp, err := r.dialer.DialContext(ctx, r.url, r.header)
+	if err != nil {
+		r.setup.Record(trace.timing(), trace.failedPhase())
+		if resp != nil {
+			err = fmt.Errorf("%v (HTTP %s)", err, resp.Status)
+		}
+		return nil, resp, err
+	}
 
-				// log.Printf("Received: %s (ID: %s)", msg.Content, msg.MessageID)
-				logger.Write(fmt.Sprintf("Round-trip time: %d us", rtt.Microseconds()))
+	if err := r.checkSubprotocol(conn); err != nil {
+		conn.Close()
+		r.setup.Record(trace.timing(), PhaseUpgrade)
+		return nil, resp, err
+	}
 
-				if !config.NoWait {
-					// Signal to send the next message
-					sendNext <- struct{}{}
-				}
-			case websocket.PingMessage:
-				// Received a ping from the server, send back a pong
-				err := conn.WriteMessage(websocket.PongMessage, nil)
-				if err != nil {
-					logger.Write(fmt.Sprintf("Error sending pong response: %v", err))
-					return // Exit the read loop if pong fails
-				}
-				logger.Write("Received ping, sent pong.")
-			case websocket.CloseMessage:
-				done <- struct{}{}
-			}
+	trace.finish()
+	timing := trace.timing()
+	r.setup.Record(timing, "")
+	r.applyCompression(conn, resp)
+
+	// The dashboard shows the first connection
+	if id == 0 {
+		connInfo := ConnectionInfo{
+			URL:         r.url,
+			LocalAddr:   conn.LocalAddr().String(),
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Handshake:   timing.Total,
+			Subprotocol: conn.Subprotocol(),
 		}
-	}()
-
-	// Send the first message to start the cycle
-	sendNext <- struct{}{}
+		if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			connInfo.TLS = &state
+		}
+		r.dashboard.SetConnection(connInfo)
+	}
 
-	// Main loop for sending messages
-	for {
-		select {
-		case <-sendNext:
-			// Generate a message ID using Snowflake algorithm
-			snowflakeID, err := snowflake.NextID()
-			if err != nil {
-				log.Printf("Error generating snowflake ID: %v", err)
-				continue
-			}
-			messageID := fmt.Sprintf("%d", snowflakeID)
+	return conn, resp, nil
+}
 
-			// Generate random content
-			content := generateRandomString(config.PayloadSize)
+// checkSubprotocol fails a new connection unless the server picked one of
+// the subprotocols offered. The dialer does not check this itself.
+func (r *clientRun) checkSubprotocol(conn *websocket.Conn) error {
+	if len(r.config.Subprotocols) == 0 {
+		return nil
+	}
+	selected := conn.Subprotocol()
+	if selected == "" {
+		return fmt.Errorf("server did not select a subprotocol, offered %s", strings.Join(r.config.Subprotocols, ", "))
+	}
+	if !slices.Contains(r.config.Subprotocols, selected) {
+		return fmt.Errorf("server selected subprotocol '%s', offered %s", selected, strings.Join(r.config.Subprotocols, ", "))
+	}
+	return nil
+}
 
-			// Create message with current timestamp
-			msg := Message{
-				Timestamp: time.Now().UTC(),
-				Content:   content,
-				MessageID: messageID,
-			}
+// subprotocolNote describes the negotiated subprotocol for connection logs
+func subprotocolNote(conn *websocket.Conn) string {
+	if conn.Subprotocol() == "" {
+		return ""
+	}
+	return fmt.Sprintf(", subprotocol: %s", conn.Subprotocol())
+}
 
-			// Marshal the message to JSON
-			msgJSON, err := json.Marshal(msg)
-			if err != nil {
-				log.Printf("Error marshaling message: %v", err)
-				continue
-			}
+// applyCompression sets the compression level of a new connection and
+// records whether permessage-deflate was negotiated
+func (r *clientRun) applyCompression(conn *websocket.Conn, resp *http.Response) {
+	if r.compression == nil {
+		return
+	}
+	conn.SetCompressionLevel(r.config.CompressLevel)
+	r.compression.RecordConn(negotiatedCompression(resp))
+}
 
-			// Send the message
-			if err := conn.WriteMessage(websocket.TextMessage, msgJSON); err != nil {
-				log.Printf("Error sending message: %v", err)
-				return err
-			}
+// runProbes runs the connections until the server goes away, the run is
+// interrupted or, if hold is set, sending stops after hold. Reporting
+// windows are taken from stats.
+func (r *clientRun) runProbes(probes []*probeConnection, hold time.Duration, stats *RTTStats) error {
+	control := newRunControl()
+
+	// Stop sending once the hold time is over
+	var deadline <-chan time.Time
+	if hold > 0 {
+		holdTimer := time.NewTimer(hold)
+		defer holdTimer.Stop()
+		deadline = holdTimer.C
+	}
 
-			// log.Printf("Sent message: %s (ID: %s)", content, messageID)
+	// Run every connection until the server goes away or the run is stopped
+	interrupt := r.interrupt
+	finished := make(chan error, len(probes))
+	for _, p := range probes {
+		go func(p *probeConnection) {
+			finished <- r.keepConnected(p, control)
+		}(p)
+	}
 
-			if config.NoWait {
-				// Signal to send the next message
-				sendNext <- struct{}{}
+	var runErr error
+	for running := len(probes); running > 0; {
+		select {
+		case err := <-finished:
+			running--
+			if err != nil && runErr == nil {
+				runErr = err
 			}
 
-			// Small delay to prevent flooding the connection
-			time.Sleep(time.Duration(config.Interval) * time.Millisecond)
+		case <-r.reportTick:
+			if report, ok := stats.TakeWindow(); ok {
+				r.results.WriteInterval(report)
+			}
 
-		case <-done:
-			return nil
+		case <-deadline:
+			deadline = nil
+			r.logger.Write(fmt.Sprintf("Run duration of %s reached", hold))
+			r.dashboard.SetState("draining")
+			control.Drain()
 
 		case <-interrupt:
-			// Send close message to server (optional but polite)
-			err := conn.WriteMessage(websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			if err != nil {
-				return fmt.Errorf("write close: %v", err)
-			}
+			interrupt = nil
+			r.aborted = true
+			r.dashboard.SetState("closing")
+			control.Abort()
+		}
+	}
 
-			// Wait for the server to close the connection
-			select {
-			case <-done:
-				// Connection closed by server
-			case <-time.After(5 * time.Second):
-				// Timed out waiting for server to close
-			}
+	return runErr
+}
 
-			return nil
+// runProfile runs every step of the load profile in turn, each on fresh
+// connections, and returns the run summary with one entry per step. It stops
+// early when a step fails or the run is interrupted.
+func (r *clientRun) runProfile(stats *RTTStats) (Summary, error) {
+	var steps []StepSummary
+	var runErr error
+	for i, load := range r.config.Profile {
+		r.logger.Write(fmt.Sprintf("Step %d/%d: %s for %s", i+1, len(r.config.Profile), load, r.config.StepDuration))
+
+		stepStats := stats.NewChild()
+		probes, err := r.dial(load, stepStats)
+		if err != nil {
+			runErr = err
+			break
+		}
+		r.dashboard.SetState(fmt.Sprintf("step %d/%d: %s", i+1, len(r.config.Profile), load))
+
+		start := time.Since(r.started)
+		runErr = r.runProbes(probes, r.config.StepDuration, stats)
+		step := StepSummary{
+			Step:    i + 1,
+			Load:    load,
+			Start:   start,
+			End:     time.Since(r.started),
+			Summary: stepStats.Summary(),
+		}
+		for _, p := range probes {
+			step.Summary.InFlight += int64(p.tracker.Pending())
+		}
+		steps = append(steps, step)
+		r.logger.Write(formatStepLine(step, len(r.config.Profile)))
+
+		if runErr != nil || r.aborted {
+			break
 		}
 	}
+
+	summary := stats.Summary()
+	summary.Setup = r.setup.Summary()
+	summary.Disconnects = r.Disconnects()
+	for _, step := range steps {
+		summary.InFlight += step.Summary.InFlight
+	}
+	summary.Steps = steps
+	return summary, runErr
 }
 
 // KeyLogWriter is a wrapper to implement io.Writer for TLS key logging
@@ -302,3 +584,81 @@ func (klw *KeyLogWriter) Write(p []byte) (n int, err error) {
 	klw.keyLogger(string(p))
 	return len(p), nil
 }
+
+// runTargets probes every target concurrently, each on its own connections,
+// and returns the run summary with one entry per target. A target that cannot
+// be connected to is marked unreachable with nothing sent, the others carry on.
+// An error is only returned if every target failed.
+func runTargets(runs []*clientRun, stats *RTTStats, reportTick <-chan time.Time) (Summary, error) {
+	config := runs[0].config
+	load := LoadStep{Rate: config.Rate, Connections: config.Connections}
+
+	type result struct {
+		target    int
+		err       error
+		connected bool
+	}
+	targetStats := make([]*RTTStats, len(runs))
+	targetProbes := make([][]*probeConnection, len(runs))
+	finished := make(chan result, len(runs))
+	for i, run := range runs {
+		targetStats[i] = stats.NewChild()
+		go func(i int, run *clientRun) {
+			run.logger.Write(fmt.Sprintf("[%s] Probing %s", run.target.Name, run.url))
+			probes, err := run.dial(load, targetStats[i])
+			if err != nil {
+				run.logger.Write(fmt.Sprintf("[%s] %v", run.target.Name, err))
+				finished <- result{target: i, err: err}
+				return
+			}
+			targetProbes[i] = probes
+			finished <- result{target: i, err: run.runProbes(probes, config.Duration, targetStats[i]), connected: true}
+		}(i, run)
+	}
+
+	targetErrs := make([]error, len(runs))
+	unreachable := make([]bool, len(runs))
+	var runErr error
+	failed := 0
+	for running := len(runs); running > 0; {
+		select {
+		case r := <-finished:
+			running--
+			targetErrs[r.target] = r.err
+			unreachable[r.target] = !r.connected
+			if r.err != nil {
+				failed++
+				if runErr == nil {
+					runErr = fmt.Errorf("%s: %v", runs[r.target].target.Name, r.err)
+				}
+			}
+
+		case <-reportTick:
+			if report, ok := stats.TakeWindow(); ok {
+				runs[0].results.WriteInterval(report)
+			}
+		}
+	}
+
+	summary := stats.Summary()
+	for i, run := range runs {
+		summary.Disconnects = append(summary.Disconnects, run.Disconnects()...)
+		target := TargetSummary{
+			Target:      run.target,
+			Setup:       run.setup.Summary(),
+			Summary:     targetStats[i].Summary(),
+			Err:         targetErrs[i],
+			Unreachable: unreachable[i],
+		}
+		for _, p := range targetProbes[i] {
+			target.Summary.InFlight += int64(p.tracker.Pending())
+		}
+		summary.InFlight += target.Summary.InFlight
+		summary.Targets = append(summary.Targets, target)
+	}
+
+	if failed < len(runs) {
+		return summary, nil
+	}
+	return summary, runErr
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compression levels accepted by -compress-level, as in compress/flate
+const (
+	minCompressionLevel     = flate.HuffmanOnly
+	maxCompressionLevel     = flate.BestCompression
+	defaultCompressionLevel = flate.BestSpeed
+)
+
+// generatePayload creates a payload of the given size whose first
+// compressibility percent is one repeated character, which deflate squeezes
+// to almost nothing, and whose rest comes from random
+func generatePayload(size, compressibility int, random func(int) string) string {
+	repeated := size * compressibility / 100
+	if repeated == 0 {
+		return random(size)
+	}
+	return strings.Repeat("a", repeated) + random(size-repeated)
+}
+
+// negotiatedCompression reports whether the upgrade response accepted the
+// permessage-deflate extension
+func negotiatedCompression(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	for _, ext := range resp.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressionStats collects what compression saved through the sockets and
+// what it cost. It is safe for concurrent use.
+type CompressionStats struct {
+	level       int
+	start       time.Time
+	cpuStart    time.Duration
+	connections atomic.Int64
+	negotiated  atomic.Int64
+
+	// Bytes through the sockets, and message bytes before compression
+	socketSent atomic.Int64
+	socketRecv atomic.Int64
+	msgSent    atomic.Int64
+	msgRecv    atomic.Int64
+
+	mu    sync.Mutex
+	write *Histogram
+	read  *Histogram
+}
+
+// NewCompressionStats starts collecting compression statistics, counting
+// CPU time from now
+func NewCompressionStats(level int) *CompressionStats {
+	return &CompressionStats{
+		level:    level,
+		start:    time.Now(),
+		cpuStart: processCPUTime(),
+		write:    NewHistogram(),
+		read:     NewHistogram(),
+	}
+}
+
+// RecordConn adds one established connection
+func (c *CompressionStats) RecordConn(negotiated bool) {
+	c.connections.Add(1)
+	if negotiated {
+		c.negotiated.Add(1)
+	}
+}
+
+// RecordWrite adds one message written, with its size before compression
+// and how long writing, and compressing, it took
+func (c *CompressionStats) RecordWrite(size int, d time.Duration) {
+	c.msgSent.Add(int64(size))
+	c.mu.Lock()
+	c.write.Record(d)
+	c.mu.Unlock()
+}
+
+// RecordRead adds one message read, with its size after decompression and
+// how long reading, and decompressing, it took from its first byte
+func (c *CompressionStats) RecordRead(size int, d time.Duration) {
+	c.msgRecv.Add(int64(size))
+	c.mu.Lock()
+	c.read.Record(d)
+	c.mu.Unlock()
+}
+
+// countingConn counts the bytes going through a socket. That includes the
+// WebSocket framing, TLS records, the upgrade and any proxy handshake, not
+// just the message payloads.
+type countingConn struct {
+	net.Conn
+	stats *CompressionStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.socketRecv.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.socketSent.Add(int64(n))
+	return n, err
+}
+
+// CompressionSummary is a snapshot of the compression statistics. Socket
+// bytes include framing, TLS, the upgrade and any proxy handshake. CPU is
+// the time of the whole process, so it is only comparable between runs.
+type CompressionSummary struct {
+	Level       int
+	Connections int64
+	Negotiated  int64
+	SocketSent  int64
+	SocketRecv  int64
+	MessageSent int64
+	MessageRecv int64
+	Messages    int64
+	Elapsed     time.Duration
+	CPU         time.Duration
+	// Cost holds the write and read time distributions per message
+	Cost []PhaseSummary
+}
+
+// ratio returns socket bytes as a fraction of message bytes
+func ratio(socket, message int64) float64 {
+	if message == 0 {
+		return 0
+	}
+	return float64(socket) / float64(message)
+}
+
+// SentRatio returns the bytes sent through the sockets per message byte
+func (s CompressionSummary) SentRatio() float64 {
+	return ratio(s.SocketSent, s.MessageSent)
+}
+
+// RecvRatio returns the bytes received through the sockets per message byte
+func (s CompressionSummary) RecvRatio() float64 {
+	return ratio(s.SocketRecv, s.MessageRecv)
+}
+
+// CPUPerMessage returns the process CPU time spent per message sent
+func (s CompressionSummary) CPUPerMessage() time.Duration {
+	if s.Messages == 0 {
+		return 0
+	}
+	return s.CPU / time.Duration(s.Messages)
+}
+
+// Summary returns a snapshot of the statistics collected so far
+func (c *CompressionStats) Summary() *CompressionSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	summary := &CompressionSummary{
+		Level:       c.level,
+		Connections: c.connections.Load(),
+		Negotiated:  c.negotiated.Load(),
+		SocketSent:  c.socketSent.Load(),
+		SocketRecv:  c.socketRecv.Load(),
+		MessageSent: c.msgSent.Load(),
+		MessageRecv: c.msgRecv.Load(),
+		Messages:    c.write.Count(),
+		Elapsed:     time.Since(c.start),
+		CPU:         processCPUTime() - c.cpuStart,
+	}
+	if c.write.Count() > 0 {
+		summary.Cost = append(summary.Cost, newPhaseSummary("write", c.write))
+	}
+	if c.read.Count() > 0 {
+		summary.Cost = append(summary.Cost, newPhaseSummary("read", c.read))
+	}
+	return summary
+}
+
+// printCompressionSummary writes whether compression was negotiated, what it
+// saved through the sockets and what it cost
+func printCompressionSummary(w io.Writer, c *CompressionSummary) {
+	fmt.Fprintf(w, "\nCompression (permessage-deflate, level %d):\n", c.Level)
+	fmt.Fprintf(w, "    Negotiated on %d of %d connection(s)\n", c.Negotiated, c.Connections)
+	fmt.Fprintf(w, "    Sent: %d message bytes as %d socket bytes (%.1f%%), Received: %d as %d (%.1f%%)\n",
+		c.MessageSent, c.SocketSent, c.SentRatio()*100,
+		c.MessageRecv, c.SocketRecv, c.RecvRatio()*100)
+	fmt.Fprintf(w, "    Socket bytes include framing, TLS, the upgrade and any proxy handshake\n")
+	fmt.Fprintf(w, "    Process CPU time = %s over %s, %d us per message sent\n",
+		c.CPU.Truncate(time.Millisecond), c.Elapsed.Truncate(time.Millisecond), c.CPUPerMessage().Microseconds())
+	if len(c.Cost) > 0 {
+		printPhaseTable(w, "Message", c.Cost)
+	}
+}
@@ -3,19 +3,125 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // Config holds application configuration
 type Config struct {
-	Addr               string
-	UseTLS             bool
-	InsecureSkipVerify bool
-	NoWait             bool
-	SSLKeyLogFile      string
-	ServerName         string
-	Headers            map[string]string
-	Interval           uint64
-	PayloadSize        uint16
+	Addr               string            `json:"addr"`
+	Path               string            `json:"path,omitempty"`
+	Targets            []Target          `json:"targets,omitempty"`
+	UseTLS             bool              `json:"use_tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	NoWait             bool              `json:"no_wait"`
+	Window             int               `json:"window,omitempty"`
+	Connections        int               `json:"connections"`
+	Reconnect          bool              `json:"reconnect,omitempty"`
+	ReconnectMax       time.Duration     `json:"reconnect_max_ns,omitempty"`
+	Churn              bool              `json:"churn,omitempty"`
+	PerConnection      bool              `json:"per_connection,omitempty"`
+	SSLKeyLogFile      string            `json:"ssl_key_log_file,omitempty"`
+	ServerName         string            `json:"server_name,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	Subprotocols       []string          `json:"subprotocols,omitempty"`
+	Proxy              string            `json:"proxy,omitempty"`
+	Routes             []Route           `json:"routes,omitempty"`
+	Interval           uint64            `json:"interval_ms"`
+	Rate               float64           `json:"rate,omitempty"`
+	Profile            []LoadStep        `json:"profile,omitempty"`
+	StepDuration       time.Duration     `json:"step_duration_ns,omitempty"`
+	PayloadSize        int               `json:"payload_size"`
+	PayloadSweep       []int             `json:"payload_sweep,omitempty"`
+	Bulk               string            `json:"bulk,omitempty"`
+	Encoding           string            `json:"encoding"`
+	Compress           bool              `json:"compress,omitempty"`
+	CompressLevel      int               `json:"compress_level,omitempty"`
+	Compressibility    int               `json:"compressibility,omitempty"`
+	Timeout            time.Duration     `json:"timeout_ns"`
+	Count              uint64            `json:"count,omitempty"`
+	Duration           time.Duration     `json:"duration_ns,omitempty"`
+	ReportInterval     time.Duration     `json:"report_interval_ns,omitempty"`
+	Thresholds         Thresholds        `json:"thresholds"`
+	OutputFormat       string            `json:"output_format"`
+	TUI                bool              `json:"tui,omitempty"`
+	RecordFile         string            `json:"record_file,omitempty"`
+	RecordFormat       string            `json:"record_format,omitempty"`
+}
+
+// targets returns the targets of the run. Without a list of targets the
+// address and TLS settings of the config make up the only one.
+func (c Config) targets() []Target {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	return []Target{{
+		Addr:               c.Addr,
+		Path:               c.Path,
+		UseTLS:             c.UseTLS,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+		Headers:            c.Headers,
+	}}
+}
+
+// subprotocolFlags is a custom flag type to handle multiple -subprotocol flags
+type subprotocolFlags struct {
+	subprotocols []string
+}
+
+// String is the method to format the flag's value
+func (s *subprotocolFlags) String() string {
+	return strings.Join(s.subprotocols, ", ")
+}
+
+// Set is the method to set the flag value
+func (s *subprotocolFlags) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ContainsAny(value, ", \t") {
+		return fmt.Errorf("invalid subprotocol (expected a single token): '%s'", value)
+	}
+	s.subprotocols = append(s.subprotocols, value)
+	return nil
+}
+
+// routeFlags is a custom flag type to handle multiple -route flags
+type routeFlags struct {
+	routes []Route
+}
+
+// String is the method to format the flag's value
+func (r *routeFlags) String() string {
+	routes := []string{}
+	for _, route := range r.routes {
+		routes = append(routes, fmt.Sprintf("%s=%s", route.Path, route.Behavior))
+	}
+	return strings.Join(routes, ", ")
+}
+
+// Set is the method to set the flag value
+func (r *routeFlags) Set(value string) error {
+	path, behavior, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid route format (expected '/path=behavior'): %s", value)
+	}
+	if path == healthCheckPath {
+		return fmt.Errorf("route %s is taken by the health check", path)
+	}
+	switch behavior {
+	case RouteEcho, RouteSink, RouteClose, RouteReject:
+	default:
+		return fmt.Errorf("invalid route behavior '%s', must be 'echo', 'sink', 'close' or 'reject'", behavior)
+	}
+	for _, route := range r.routes {
+		if route.Path == path {
+			return fmt.Errorf("route %s is given twice", path)
+		}
+	}
+	if err := checkRoute(path, r.routes); err != nil {
+		return err
+	}
+	r.routes = append(r.routes, Route{Path: path, Behavior: behavior})
+	return nil
 }
 
 // headerFlags is a custom flag type to handle multiple -H flags
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns the user and kernel CPU time used by the process
+func processCPUTime() time.Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	if err := syscall.GetProcessTimes(process, &creation, &exit, &kernel, &user); err != nil {
+		return 0
+	}
+	return filetimeDuration(kernel) + filetimeDuration(user)
+}
+
+// filetimeDuration converts a Filetime holding a duration, counted in 100
+// nanosecond intervals
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	ticks := int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+	return time.Duration(ticks * 100)
+}
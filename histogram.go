@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Histogram is a log-linear latency histogram in the spirit of HdrHistogram.
+// Values are recorded in nanoseconds with three significant decimal digits of
+// precision, so memory stays bounded no matter how many samples are recorded.
+type Histogram struct {
+	counts     []int64
+	totalCount int64
+	min        int64
+	max        int64
+	sum        float64
+}
+
+const (
+	// histogramSubBucketBits gives 2048 sub-buckets per power of two, which
+	// keeps the relative error of any recorded value below 0.1%
+	histogramSubBucketBits  = 11
+	histogramSubBucketCount = 1 << histogramSubBucketBits
+	histogramSubBucketHalf  = histogramSubBucketCount / 2
+
+	// histogramMaxValue is the highest trackable value (one hour), larger
+	// values are clamped to it
+	histogramMaxValue = int64(time.Hour)
+)
+
+// NewHistogram creates an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{
+		min: math.MaxInt64,
+		max: 0,
+	}
+}
+
+// bucketIndex returns the counts index holding the given value
+func bucketIndex(value int64) int {
+	bucket := bits.Len64(uint64(value)) - histogramSubBucketBits
+	if bucket < 0 {
+		bucket = 0
+	}
+	subBucket := int(value >> uint(bucket))
+	return bucket*histogramSubBucketHalf + subBucket
+}
+
+// valueRange returns the lowest and highest values that map to the given index
+func valueRange(index int) (int64, int64) {
+	bucket := 0
+	subBucket := index
+	if index >= histogramSubBucketCount {
+		bucket = index/histogramSubBucketHalf - 1
+		subBucket = index - bucket*histogramSubBucketHalf
+	}
+	lowest := int64(subBucket) << uint(bucket)
+	highest := (int64(subBucket+1) << uint(bucket)) - 1
+	return lowest, highest
+}
+
+// Record adds a single duration to the histogram
+func (h *Histogram) Record(d time.Duration) {
+	h.RecordN(d, 1)
+}
+
+// RecordN adds a duration to the histogram n times
+func (h *Histogram) RecordN(d time.Duration, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	value := int64(d)
+	if value < 0 {
+		value = 0
+	}
+	if value > histogramMaxValue {
+		value = histogramMaxValue
+	}
+
+	index := bucketIndex(value)
+	if index >= len(h.counts) {
+		// Grow lazily so short runs on fast links stay small
+		grown := make([]int64, index+1)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+
+	h.counts[index] += n
+	h.totalCount += n
+	h.sum += float64(value) * float64(n)
+	if value < h.min {
+		h.min = value
+	}
+	if value > h.max {
+		h.max = value
+	}
+}
+
+// Merge adds all values recorded in other to this histogram
+func (h *Histogram) Merge(other *Histogram) {
+	if other == nil || other.totalCount == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		grown := make([]int64, len(other.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.totalCount += other.totalCount
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Reset clears all recorded values while keeping the allocated buckets
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.totalCount = 0
+	h.sum = 0
+	h.min = math.MaxInt64
+	h.max = 0
+}
+
+// Count returns the number of recorded values
+func (h *Histogram) Count() int64 {
+	return h.totalCount
+}
+
+// Min returns the smallest recorded value
+func (h *Histogram) Min() time.Duration {
+	if h.totalCount == 0 {
+		return 0
+	}
+	return time.Duration(h.min)
+}
+
+// Max returns the largest recorded value
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
+
+// Mean returns the exact arithmetic mean of the recorded values
+func (h *Histogram) Mean() time.Duration {
+	if h.totalCount == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.totalCount))
+}
+
+// Percentile returns the value below which the given percentage (0-100) of
+// recorded values fall
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.totalCount == 0 {
+		return 0
+	}
+	if p >= 100 {
+		return time.Duration(h.max)
+	}
+	if p < 0 {
+		p = 0
+	}
+
+	// Multiply before dividing: p / 100 is inexact, and 99.9 / 100 * 1000
+	// comes out just above 999, which would round up to the last value
+	target := int64(math.Ceil(p * float64(h.totalCount) / 100))
+	if target < 1 {
+		target = 1
+	}
+
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			_, highest := valueRange(i)
+			// Never report more than what was actually observed
+			if highest > h.max {
+				highest = h.max
+			}
+			if highest < h.min {
+				highest = h.min
+			}
+			return time.Duration(highest)
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// MeanAbsDeviation returns the mean absolute deviation of the recorded
+// values around the given center, using the midpoint of each bucket
+func (h *Histogram) MeanAbsDeviation(center time.Duration) time.Duration {
+	if h.totalCount == 0 {
+		return 0
+	}
+
+	var total float64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		lowest, highest := valueRange(i)
+		mid := float64(lowest+highest) / 2
+		total += math.Abs(mid-float64(center)) * float64(c)
+	}
+	return time.Duration(total / float64(h.totalCount))
+}
+
+// HistogramBin is one bin of a coarse latency distribution
+type HistogramBin struct {
+	Lower time.Duration
+	Upper time.Duration
+	Count int64
+}
+
+// Distribution folds the recorded values into power-of-two microsecond bins,
+// skipping empty bins at either end
+func (h *Histogram) Distribution() []HistogramBin {
+	if h.totalCount == 0 {
+		return nil
+	}
+
+	var bins []HistogramBin
+	upper := time.Microsecond
+	lower := time.Duration(0)
+	index := 0
+	for lower <= time.Duration(h.max) {
+		var count int64
+		for ; index < len(h.counts); index++ {
+			lowest, _ := valueRange(index)
+			if time.Duration(lowest) >= upper {
+				break
+			}
+			count += h.counts[index]
+		}
+		bins = append(bins, HistogramBin{Lower: lower, Upper: upper, Count: count})
+		lower = upper
+		upper *= 2
+	}
+
+	// Trim leading empty bins
+	for len(bins) > 0 && bins[0].Count == 0 {
+		bins = bins[1:]
+	}
+	return bins
+}
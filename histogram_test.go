@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	tests := []struct {
+		value     int64
+		wantIndex int
+		wantLow   int64
+		wantHigh  int64
+	}{
+		{value: 0, wantIndex: 0, wantLow: 0, wantHigh: 0},
+		{value: 1, wantIndex: 1, wantLow: 1, wantHigh: 1},
+		{value: 2047, wantIndex: 2047, wantLow: 2047, wantHigh: 2047},
+		{value: 2048, wantIndex: 2048, wantLow: 2048, wantHigh: 2049},
+		{value: 2049, wantIndex: 2048, wantLow: 2048, wantHigh: 2049},
+		{value: 4095, wantIndex: 3071, wantLow: 4094, wantHigh: 4095},
+		{value: 4096, wantIndex: 3072, wantLow: 4096, wantHigh: 4099},
+		{value: 1000000, wantIndex: 9*1024 + 1000000>>9, wantLow: 999936, wantHigh: 1000447},
+	}
+	for _, tt := range tests {
+		index := bucketIndex(tt.value)
+		if index != tt.wantIndex {
+			t.Errorf("bucketIndex(%d) = %d, want %d", tt.value, index, tt.wantIndex)
+		}
+		low, high := valueRange(index)
+		if low != tt.wantLow || high != tt.wantHigh {
+			t.Errorf("valueRange(%d) = %d-%d, want %d-%d", index, low, high, tt.wantLow, tt.wantHigh)
+		}
+	}
+}
+
+func TestBucketIndexCoversValues(t *testing.T) {
+	// Every value falls in the range of its bucket, buckets never go back
+	// and no bucket is wider than 0.1% of its values
+	previous := -1
+	for value := int64(0); value <= histogramMaxValue; value += 1 + value/997 {
+		index := bucketIndex(value)
+		if index < previous {
+			t.Fatalf("bucketIndex(%d) = %d, below the index %d of a smaller value", value, index, previous)
+		}
+		previous = index
+
+		low, high := valueRange(index)
+		if value < low || value > high {
+			t.Fatalf("value %d outside the range %d-%d of its bucket %d", value, low, high, index)
+		}
+		if width := high - low; low > 0 && float64(width)/float64(low) > 0.001 {
+			t.Fatalf("bucket %d (%d-%d) is wider than 0.1%%", index, low, high)
+		}
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	uniform := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		uniform.Record(time.Duration(i) * time.Microsecond)
+	}
+	single := NewHistogram()
+	single.Record(1234567 * time.Nanosecond)
+	clamped := NewHistogram()
+	clamped.Record(-time.Second)
+	clamped.Record(2 * time.Hour)
+
+	tests := []struct {
+		name       string
+		histogram  *Histogram
+		percentile float64
+		want       time.Duration
+	}{
+		{name: "empty", histogram: NewHistogram(), percentile: 50, want: 0},
+		{name: "p0 is the minimum", histogram: uniform, percentile: 0, want: time.Microsecond},
+		{name: "p50", histogram: uniform, percentile: 50, want: 500 * time.Microsecond},
+		{name: "p90", histogram: uniform, percentile: 90, want: 900 * time.Microsecond},
+		{name: "p99", histogram: uniform, percentile: 99, want: 990 * time.Microsecond},
+		{name: "p99.9", histogram: uniform, percentile: 99.9, want: 999 * time.Microsecond},
+		{name: "p100 is the maximum", histogram: uniform, percentile: 100, want: 1000 * time.Microsecond},
+		{name: "single value", histogram: single, percentile: 50, want: 1234567 * time.Nanosecond},
+		{name: "negative clamped to zero", histogram: clamped, percentile: 0, want: 0},
+		{name: "large clamped to an hour", histogram: clamped, percentile: 100, want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.histogram.Percentile(tt.percentile)
+			// Buckets keep three significant digits, and never go past max
+			if diff := got - tt.want; diff < 0 || float64(diff) > float64(tt.want)*0.001 {
+				t.Errorf("Percentile(%v) = %v, want %v within 0.1%% above", tt.percentile, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramStatistics(t *testing.T) {
+	h := NewHistogram()
+	h.RecordN(100*time.Microsecond, 3)
+	h.Record(500 * time.Microsecond)
+	h.RecordN(time.Second, 0)
+
+	other := NewHistogram()
+	other.Record(20 * time.Microsecond)
+	h.Merge(other)
+	h.Merge(nil)
+
+	if h.Count() != 5 {
+		t.Errorf("Count = %d, want 5", h.Count())
+	}
+	if h.Min() != 20*time.Microsecond || h.Max() != 500*time.Microsecond {
+		t.Errorf("Min, Max = %v, %v, want 20us, 500us", h.Min(), h.Max())
+	}
+	if want := 164 * time.Microsecond; h.Mean() != want {
+		t.Errorf("Mean = %v, want %v", h.Mean(), want)
+	}
+
+	h.Reset()
+	if h.Count() != 0 || h.Min() != 0 || h.Max() != 0 || h.Mean() != 0 || h.Percentile(99) != 0 {
+		t.Errorf("statistics not zero after Reset")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 )
@@ -11,14 +12,16 @@ import (
 type BufferedLogger struct {
 	buffer    bytes.Buffer
 	mutex     sync.Mutex
+	out       io.Writer
 	flushSize int
 	interval  time.Duration
 	stopChan  chan struct{}
 }
 
-// NewBufferedLogger creates a new buffered logger
-func NewBufferedLogger(flushSize int, interval time.Duration) *BufferedLogger {
+// NewBufferedLogger creates a new buffered logger writing to out
+func NewBufferedLogger(out io.Writer, flushSize int, interval time.Duration) *BufferedLogger {
 	bl := &BufferedLogger{
+		out:       out,
 		flushSize: flushSize,
 		interval:  interval,
 		stopChan:  make(chan struct{}),
@@ -49,7 +52,7 @@ func (bl *BufferedLogger) Write(msg string) {
 	}
 }
 
-// Flush writes all buffered log messages to stdout
+// Flush writes all buffered log messages to the output
 func (bl *BufferedLogger) Flush() {
 	bl.mutex.Lock()
 	defer bl.mutex.Unlock()
@@ -57,10 +60,10 @@ func (bl *BufferedLogger) Flush() {
 	bl.flushLocked()
 }
 
-// flushLocked writes buffer to stdout (must be called with mutex held)
+// flushLocked writes buffer to the output (must be called with mutex held)
 func (bl *BufferedLogger) flushLocked() {
 	if bl.buffer.Len() > 0 {
-		fmt.Print(bl.buffer.String())
+		bl.out.Write(bl.buffer.Bytes())
 		bl.buffer.Reset()
 	}
 }
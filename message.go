@@ -1,6 +1,20 @@
 package main
 
-import "time"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message encodings accepted by the -encoding flag
+const (
+	EncodingJSON   = "json"
+	EncodingBinary = "binary"
+)
 
 // Message defines the structure for the JSON messages exchanged between client and server
 type Message struct {
@@ -12,4 +26,119 @@ type Message struct {
 
 	// Unique message identifier (used by client)
 	MessageID string `json:"message_id,omitempty"`
+
+	// Monotonically increasing sequence number, echoed back unchanged by the server
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Bulk asks the server to reply with no content ("up") or with Size
+	// bytes of content ("down") instead of echoing the content back
+	Bulk string `json:"bulk,omitempty"`
+	Size int    `json:"size,omitempty"`
+}
+
+// The binary encoding is a fixed big-endian header followed by the content:
+//
+//	offset  size  field
+//	0       1     version, binaryMessageVersion
+//	1       1     bulk mode: 0 none, 1 up, 2 down, 3 echo
+//	2       2     reserved, zero
+//	4       4     requested bulk download size
+//	8       8     sequence number
+//	16      8     Snowflake message ID, its raw 64 bit pattern, 0 if none
+//	24      8     timestamp, nanoseconds since the Unix epoch
+//	32      -     content
+//
+// The Snowflake timestamp is in nanoseconds and shifted left 22 bits, so its
+// top bits are dropped: IDs are any int64, negative ones included, and wrap
+// about every 73 minutes. They are only unique among messages in flight, so
+// the ID field is an opaque bit pattern, not a number to compare or order.
+const (
+	binaryMessageVersion    = 1
+	binaryMessageHeaderSize = 32
+)
+
+// binaryBulkModes maps the bulk modes to their code in the binary header
+var binaryBulkModes = []string{"", BulkUpload, BulkDownload, BulkEcho}
+
+// MarshalBinary encodes the message in the binary wire format. The message
+// ID must be empty or a decimal Snowflake ID, which may be negative.
+func (m Message) MarshalBinary() ([]byte, error) {
+	var id int64
+	if m.MessageID != "" {
+		var err error
+		if id, err = strconv.ParseInt(m.MessageID, 10, 64); err != nil {
+			return nil, fmt.Errorf("message ID '%s' is not a Snowflake ID", m.MessageID)
+		}
+	}
+	mode := -1
+	for code, name := range binaryBulkModes {
+		if m.Bulk == name {
+			mode = code
+		}
+	}
+	if mode < 0 {
+		return nil, fmt.Errorf("unknown bulk mode '%s'", m.Bulk)
+	}
+	if m.Size < 0 || m.Size > maxPayloadSize {
+		return nil, fmt.Errorf("bulk size %d out of range", m.Size)
+	}
+
+	data := make([]byte, binaryMessageHeaderSize+len(m.Content))
+	data[0] = binaryMessageVersion
+	data[1] = byte(mode)
+	binary.BigEndian.PutUint32(data[4:], uint32(m.Size))
+	binary.BigEndian.PutUint64(data[8:], m.Seq)
+	binary.BigEndian.PutUint64(data[16:], uint64(id))
+	binary.BigEndian.PutUint64(data[24:], uint64(m.Timestamp.UnixNano()))
+	copy(data[binaryMessageHeaderSize:], m.Content)
+	return data, nil
+}
+
+// UnmarshalBinary decodes a message in the binary wire format
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if len(data) < binaryMessageHeaderSize {
+		return fmt.Errorf("binary message too short: %d bytes", len(data))
+	}
+	if data[0] != binaryMessageVersion {
+		return fmt.Errorf("unsupported binary message version %d", data[0])
+	}
+	if int(data[1]) >= len(binaryBulkModes) {
+		return fmt.Errorf("unknown bulk mode %d", data[1])
+	}
+
+	*m = Message{
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(data[24:]))).UTC(),
+		Content:   string(data[binaryMessageHeaderSize:]),
+		Seq:       binary.BigEndian.Uint64(data[8:]),
+		Bulk:      binaryBulkModes[data[1]],
+		Size:      int(binary.BigEndian.Uint32(data[4:])),
+	}
+	if id := int64(binary.BigEndian.Uint64(data[16:])); id != 0 {
+		m.MessageID = strconv.FormatInt(id, 10)
+	}
+	return nil
+}
+
+// encodeMessage encodes a message as a frame of the given encoding and
+// returns the frame type to send it as
+func encodeMessage(msg Message, encoding string) (int, []byte, error) {
+	if encoding == EncodingBinary {
+		data, err := msg.MarshalBinary()
+		return websocket.BinaryMessage, data, err
+	}
+	data, err := json.Marshal(msg)
+	return websocket.TextMessage, data, err
+}
+
+// decodeMessage decodes a frame of either encoding, text frames holding JSON
+// and binary frames the binary wire format
+func decodeMessage(messageType int, data []byte) (Message, error) {
+	var msg Message
+	switch messageType {
+	case websocket.TextMessage:
+		return msg, json.Unmarshal(data, &msg)
+	case websocket.BinaryMessage:
+		return msg, msg.UnmarshalBinary(data)
+	}
+	return msg, fmt.Errorf("unexpected frame type %d", messageType)
 }
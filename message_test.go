@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMessageBinaryRoundTrip(t *testing.T) {
+	timestamp := time.Date(2026, 3, 1, 12, 30, 45, 123456789, time.UTC)
+
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{name: "no ID", msg: Message{Timestamp: timestamp, Content: "hello", Seq: 1}},
+		{name: "Snowflake ID", msg: Message{Timestamp: timestamp, Content: "hello", MessageID: "7313486290381422592", Seq: 42}},
+		// The nanosecond Snowflake timestamp overflows into the sign bit
+		{name: "negative ID", msg: Message{Timestamp: timestamp, MessageID: "-691340043408576512", Seq: 2}},
+		{name: "largest ID", msg: Message{Timestamp: timestamp, MessageID: strconv.FormatInt(math.MaxInt64, 10)}},
+		{name: "smallest ID", msg: Message{Timestamp: timestamp, MessageID: strconv.FormatInt(math.MinInt64, 10)}},
+		{name: "largest sequence", msg: Message{Timestamp: timestamp, Seq: math.MaxUint64}},
+		{name: "binary content", msg: Message{Timestamp: timestamp, Content: "\x00\xff\x7f{}"}},
+		{name: "before the epoch", msg: Message{Timestamp: time.Unix(-5, 0).UTC()}},
+		{name: "bulk upload", msg: Message{Timestamp: timestamp, Content: "payload", Bulk: BulkUpload}},
+		{name: "bulk download", msg: Message{Timestamp: timestamp, Bulk: BulkDownload, Size: maxPayloadSize}},
+		{name: "bulk echo", msg: Message{Timestamp: timestamp, Content: "payload", Bulk: BulkEcho}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != binaryMessageHeaderSize+len(tt.msg.Content) {
+				t.Errorf("encoded %d bytes, want %d", len(data), binaryMessageHeaderSize+len(tt.msg.Content))
+			}
+
+			var got Message
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.msg {
+				t.Errorf("round trip = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestMessageBinarySnowflakeIDs(t *testing.T) {
+	snowflake, err := NewSnowflake(1023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		id, err := snowflake.NextID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := Message{Timestamp: time.Now().UTC(), MessageID: strconv.FormatInt(id, 10)}
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary of Snowflake ID %d: %v", id, err)
+		}
+		var got Message
+		if err := got.UnmarshalBinary(data); err != nil || got.MessageID != msg.MessageID {
+			t.Fatalf("Snowflake ID %d came back as %q (%v)", id, got.MessageID, err)
+		}
+	}
+}
+
+func TestMessageBinaryLayout(t *testing.T) {
+	msg := Message{
+		Timestamp: time.Unix(0, 0x0102030405060708).UTC(),
+		Content:   "xyz",
+		MessageID: "-2",
+		Seq:       0x1112131415161718,
+		Bulk:      BulkDownload,
+		Size:      0x00212223,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{binaryMessageVersion, 2, 0, 0, 0x00, 0x21, 0x22, 0x23}
+	want = binary.BigEndian.AppendUint64(want, 0x1112131415161718)
+	want = append(want, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe)
+	want = binary.BigEndian.AppendUint64(want, 0x0102030405060708)
+	want = append(want, "xyz"...)
+	if !bytes.Equal(data, want) {
+		t.Errorf("MarshalBinary = % x, want % x", data, want)
+	}
+}
+
+func TestMessageBinaryErrors(t *testing.T) {
+	valid, err := Message{Timestamp: time.Unix(1, 0), Content: "x"}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withByte := func(offset int, value byte) []byte {
+		data := bytes.Clone(valid)
+		data[offset] = value
+		return data
+	}
+
+	marshal := []struct {
+		name string
+		msg  Message
+	}{
+		{name: "non-numeric ID", msg: Message{MessageID: "abc"}},
+		{name: "ID out of range", msg: Message{MessageID: "9223372036854775808"}},
+		{name: "unknown bulk mode", msg: Message{Bulk: "sideways"}},
+		{name: "negative bulk size", msg: Message{Bulk: BulkDownload, Size: -1}},
+		{name: "bulk size too large", msg: Message{Bulk: BulkDownload, Size: maxPayloadSize + 1}},
+	}
+	for _, tt := range marshal {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.MarshalBinary(); err == nil {
+				t.Errorf("MarshalBinary(%+v) succeeded, want error", tt.msg)
+			}
+		})
+	}
+
+	unmarshal := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "short header", data: valid[:binaryMessageHeaderSize-1]},
+		{name: "unknown version", data: withByte(0, binaryMessageVersion+1)},
+		{name: "unknown bulk mode", data: withByte(1, byte(len(binaryBulkModes)))},
+	}
+	for _, tt := range unmarshal {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg Message
+			if err := msg.UnmarshalBinary(tt.data); err == nil {
+				t.Errorf("UnmarshalBinary(% x) succeeded, want error", tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,926 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats accepted by the -output flag
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputCSV  = "csv"
+)
+
+// resultSchemaVersion identifies the layout of the JSON records and CSV
+// columns written by -output
+const resultSchemaVersion = 1
+
+// Sample is a single round trip measurement
+type Sample struct {
+	// Target is the name of the target, set when probing several
+	Target    string
+	ConnID    int
+	MessageID string
+	// Seq is the sequence number the message was sent with
+	Seq      uint64
+	SendTime time.Time
+	RecvTime time.Time
+	// IntendedTime is when an open-loop sender meant to send the message.
+	// When set, RTT is measured from it rather than from SendTime.
+	IntendedTime time.Time
+	RTT          time.Duration
+	PayloadSize  int
+	// SendTransfer and RecvTransfer are how long a bulk message took to
+	// write and its reply took to arrive from first to last byte
+	SendTransfer time.Duration
+	RecvTransfer time.Duration
+}
+
+// ResultWriter emits per-message samples and the final summary of a client run
+type ResultWriter interface {
+	// WriteSample records a single measurement
+	WriteSample(sample Sample)
+	// WriteInterval records the statistics of one reporting window
+	WriteInterval(report IntervalReport)
+	// WriteSummary records the statistics of the whole run
+	WriteSummary(summary Summary)
+	// Close flushes any buffered output
+	Close() error
+}
+
+// NewResultWriter creates a ResultWriter for the output format of the config.
+// Text output goes through the buffered logger, structured output is written to out.
+func NewResultWriter(config Config, out io.Writer, logger *BufferedLogger) (ResultWriter, error) {
+	switch format := config.OutputFormat; format {
+	case OutputText, "":
+		return &textResultWriter{out: out, logger: logger, labelConns: config.Connections > 1}, nil
+	case OutputJSON:
+		w := bufio.NewWriter(out)
+		return &jsonResultWriter{w: w, encoder: json.NewEncoder(w)}, nil
+	case OutputCSV:
+		return newCSVResultWriter(out), nil
+	default:
+		return nil, fmt.Errorf("unknown output format '%s' (expected text, json or csv)", format)
+	}
+}
+
+// teeResultWriter forwards everything to several writers
+type teeResultWriter []ResultWriter
+
+func (t teeResultWriter) WriteSample(sample Sample) {
+	for _, w := range t {
+		w.WriteSample(sample)
+	}
+}
+
+func (t teeResultWriter) WriteInterval(report IntervalReport) {
+	for _, w := range t {
+		w.WriteInterval(report)
+	}
+}
+
+func (t teeResultWriter) WriteSummary(summary Summary) {
+	for _, w := range t {
+		w.WriteSummary(summary)
+	}
+}
+
+// Close closes every writer and returns the first error
+func (t teeResultWriter) Close() error {
+	var firstErr error
+	for _, w := range t {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// textResultWriter writes the human readable output
+type textResultWriter struct {
+	out        io.Writer
+	logger     *BufferedLogger
+	labelConns bool
+}
+
+func (t *textResultWriter) WriteSample(sample Sample) {
+	line := fmt.Sprintf("%sRound-trip time: %d us",
+		connLabel(sample.Target, sample.ConnID, t.labelConns), sample.RTT.Microseconds())
+	if sample.SendTransfer > 0 || sample.RecvTransfer > 0 {
+		line += fmt.Sprintf(", send %d us, receive %d us",
+			sample.SendTransfer.Microseconds(), sample.RecvTransfer.Microseconds())
+	}
+	t.logger.Write(line)
+}
+
+func (t *textResultWriter) WriteInterval(report IntervalReport) {
+	t.logger.Write(formatIntervalLine(report))
+}
+
+func (t *textResultWriter) WriteSummary(summary Summary) {
+	// Make sure the summary is not interleaved with pending log lines
+	t.logger.Flush()
+	printSummary(t.out, summary)
+}
+
+func (t *textResultWriter) Close() error {
+	return nil
+}
+
+// sampleRecord is the structured form of a Sample
+type sampleRecord struct {
+	Type          string `json:"type"`
+	SchemaVersion int    `json:"schema_version"`
+	MessageID     string `json:"message_id"`
+	Seq           uint64 `json:"seq"`
+	SendTime      string `json:"send_time"`
+	RecvTime      string `json:"recv_time"`
+	IntendedTime  string `json:"intended_time,omitempty"`
+	RTTNs         int64  `json:"rtt_ns"`
+	PayloadSize   int    `json:"payload_size"`
+	ConnID        int    `json:"conn_id"`
+	Target        string `json:"target,omitempty"`
+	SendTransfer  int64  `json:"send_transfer_ns,omitempty"`
+	RecvTransfer  int64  `json:"recv_transfer_ns,omitempty"`
+}
+
+// summaryRecord is the structured form of a Summary
+type summaryRecord struct {
+	Type          string             `json:"type"`
+	SchemaVersion int                `json:"schema_version"`
+	Sent          int64              `json:"sent"`
+	Count         int64              `json:"count"`
+	Lost          int64              `json:"lost"`
+	Late          int64              `json:"late"`
+	InFlight      int64              `json:"in_flight"`
+	LossPercent   float64            `json:"loss_percent"`
+	Duplicates    int64              `json:"duplicates"`
+	Reordered     int64              `json:"reordered"`
+	Gaps          int64              `json:"gaps"`
+	Skipped       int64              `json:"skipped"`
+	MinNs         int64              `json:"min_ns"`
+	MaxNs         int64              `json:"max_ns"`
+	MeanNs        int64              `json:"mean_ns"`
+	StdDevNs      int64              `json:"stddev_ns"`
+	MeanAbsDevNs  int64              `json:"mean_abs_dev_ns"`
+	JitterNs      int64              `json:"jitter_ns"`
+	Percentiles   map[string]int64   `json:"percentiles_ns"`
+	Distribution  []binRecord        `json:"distribution"`
+	Connections   []connRecord       `json:"connections,omitempty"`
+	Steps         []stepRecord       `json:"steps,omitempty"`
+	Sizes         []sizeRecord       `json:"sizes,omitempty"`
+	Bulk          *bulkRecord        `json:"bulk,omitempty"`
+	Compression   *compressionRecord `json:"compression,omitempty"`
+	Setup         *setupRecord       `json:"setup,omitempty"`
+	Targets       []targetRecord     `json:"targets,omitempty"`
+	Disconnects   []disconnectRecord `json:"disconnects,omitempty"`
+}
+
+// connRecord is the structured form of a ConnectionSummary
+type connRecord struct {
+	ConnID    int           `json:"conn_id"`
+	NodeID    int64         `json:"node_id"`
+	LocalAddr string        `json:"local_addr"`
+	Summary   summaryRecord `json:"summary"`
+}
+
+// stepRecord is the structured form of a StepSummary
+type stepRecord struct {
+	Step        int           `json:"step"`
+	Rate        float64       `json:"rate"`
+	Connections int           `json:"connections"`
+	StartNs     int64         `json:"step_start_ns"`
+	EndNs       int64         `json:"step_end_ns"`
+	Summary     summaryRecord `json:"summary"`
+}
+
+// sizeRecord is the structured form of a SizeSummary
+type sizeRecord struct {
+	PayloadSize int           `json:"payload_size"`
+	StartNs     int64         `json:"size_start_ns"`
+	EndNs       int64         `json:"size_end_ns"`
+	Throughput  float64       `json:"throughput_bytes_per_sec"`
+	Summary     summaryRecord `json:"summary"`
+}
+
+// bulkRecord is the structured form of a BulkSummary
+type bulkRecord struct {
+	Direction    string        `json:"direction"`
+	PayloadSize  int           `json:"payload_size"`
+	Messages     int64         `json:"messages"`
+	ElapsedNs    int64         `json:"elapsed_ns"`
+	SentBytes    int64         `json:"sent_bytes"`
+	RecvBytes    int64         `json:"received_bytes"`
+	UploadRate   float64       `json:"upload_bytes_per_sec"`
+	DownloadRate float64       `json:"download_bytes_per_sec"`
+	EchoRate     float64       `json:"echo_bytes_per_sec,omitempty"`
+	Transfer     []phaseRecord `json:"transfer"`
+}
+
+func newBulkRecord(bulk *BulkSummary) *bulkRecord {
+	record := &bulkRecord{
+		Direction:    bulk.Direction,
+		PayloadSize:  bulk.Size,
+		Messages:     bulk.Messages,
+		ElapsedNs:    bulk.Elapsed.Nanoseconds(),
+		SentBytes:    bulk.SentBytes,
+		RecvBytes:    bulk.RecvBytes,
+		UploadRate:   bulk.UploadRate(),
+		DownloadRate: bulk.DownloadRate(),
+		EchoRate:     bulk.EchoRate(),
+		Transfer:     []phaseRecord{},
+	}
+	for _, p := range bulk.Transfer {
+		record.Transfer = append(record.Transfer, newPhaseRecord(p))
+	}
+	return record
+}
+
+// compressionRecord is the structured form of a CompressionSummary
+type compressionRecord struct {
+	Level         int           `json:"level"`
+	Connections   int64         `json:"connections"`
+	Negotiated    int64         `json:"negotiated"`
+	MessageSent   int64         `json:"message_sent_bytes"`
+	SocketSent    int64         `json:"socket_sent_bytes"`
+	SentRatio     float64       `json:"sent_ratio"`
+	MessageRecv   int64         `json:"message_received_bytes"`
+	SocketRecv    int64         `json:"socket_received_bytes"`
+	RecvRatio     float64       `json:"received_ratio"`
+	ElapsedNs     int64         `json:"elapsed_ns"`
+	CPUNs         int64         `json:"cpu_ns"`
+	CPUPerMessage int64         `json:"cpu_per_message_ns"`
+	Cost          []phaseRecord `json:"cost"`
+}
+
+func newCompressionRecord(c *CompressionSummary) *compressionRecord {
+	record := &compressionRecord{
+		Level:         c.Level,
+		Connections:   c.Connections,
+		Negotiated:    c.Negotiated,
+		MessageSent:   c.MessageSent,
+		SocketSent:    c.SocketSent,
+		SentRatio:     c.SentRatio(),
+		MessageRecv:   c.MessageRecv,
+		SocketRecv:    c.SocketRecv,
+		RecvRatio:     c.RecvRatio(),
+		ElapsedNs:     c.Elapsed.Nanoseconds(),
+		CPUNs:         c.CPU.Nanoseconds(),
+		CPUPerMessage: c.CPUPerMessage().Nanoseconds(),
+		Cost:          []phaseRecord{},
+	}
+	for _, p := range c.Cost {
+		record.Cost = append(record.Cost, newPhaseRecord(p))
+	}
+	return record
+}
+
+// targetRecord is the structured form of a TargetSummary
+type targetRecord struct {
+	Name        string        `json:"name"`
+	URL         string        `json:"url"`
+	Error       string        `json:"error,omitempty"`
+	Unreachable bool          `json:"unreachable,omitempty"`
+	Setup       *setupRecord  `json:"setup,omitempty"`
+	Summary     summaryRecord `json:"summary"`
+}
+
+// disconnectRecord is the structured form of a DisconnectEvent
+type disconnectRecord struct {
+	Target      string `json:"target,omitempty"`
+	ConnID      int    `json:"conn_id"`
+	Session     int    `json:"session"`
+	RemoteAddr  string `json:"remote_addr"`
+	StartNs     int64  `json:"session_start_ns"`
+	EndNs       int64  `json:"session_end_ns"`
+	CloseCode   int    `json:"close_code,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	DowntimeNs  int64  `json:"downtime_ns"`
+	Reconnected bool   `json:"reconnected"`
+	Attempts    int    `json:"attempts"`
+}
+
+func newDisconnectRecord(event DisconnectEvent) disconnectRecord {
+	return disconnectRecord{
+		Target:      event.Target,
+		ConnID:      event.ConnID,
+		Session:     event.Session,
+		RemoteAddr:  event.RemoteAddr,
+		StartNs:     event.Start.Nanoseconds(),
+		EndNs:       event.End.Nanoseconds(),
+		CloseCode:   event.CloseCode,
+		Reason:      event.Reason,
+		DowntimeNs:  event.Downtime.Nanoseconds(),
+		Reconnected: event.Reconnected,
+		Attempts:    event.Attempts,
+	}
+}
+
+// setupRecord is the structured form of a SetupSummary
+type setupRecord struct {
+	Attempts       int64            `json:"attempts"`
+	Failures       int64            `json:"failures"`
+	FailurePercent float64          `json:"failure_percent"`
+	FailedDuring   map[string]int64 `json:"failed_during"`
+	Phases         []phaseRecord    `json:"phases"`
+	TLS            *tlsRecord       `json:"tls,omitempty"`
+}
+
+// tlsRecord is the structured form of a TLSSummary
+type tlsRecord struct {
+	Handshakes   int64            `json:"handshakes"`
+	Resumed      int64            `json:"resumed"`
+	Versions     map[string]int64 `json:"versions"`
+	CipherSuites map[string]int64 `json:"cipher_suites"`
+	ALPN         map[string]int64 `json:"alpn"`
+}
+
+func newTLSRecord(summary *TLSSummary) *tlsRecord {
+	record := &tlsRecord{
+		Handshakes:   summary.Handshakes,
+		Resumed:      summary.Resumed,
+		Versions:     map[string]int64{},
+		CipherSuites: map[string]int64{},
+		ALPN:         map[string]int64{},
+	}
+	for _, c := range summary.Versions {
+		record.Versions[c.Value] = c.Count
+	}
+	for _, c := range summary.CipherSuites {
+		record.CipherSuites[c.Value] = c.Count
+	}
+	for _, c := range summary.ALPN {
+		record.ALPN[c.Value] = c.Count
+	}
+	return record
+}
+
+// phaseRecord is the structured form of a PhaseSummary
+type phaseRecord struct {
+	Phase       string           `json:"phase"`
+	Count       int64            `json:"count"`
+	MinNs       int64            `json:"min_ns"`
+	MeanNs      int64            `json:"mean_ns"`
+	MaxNs       int64            `json:"max_ns"`
+	Percentiles map[string]int64 `json:"percentiles_ns"`
+}
+
+func newSetupRecord(setup *SetupSummary) *setupRecord {
+	record := &setupRecord{
+		Attempts:       setup.Attempts,
+		Failures:       setup.Failures,
+		FailurePercent: setup.FailurePercent(),
+		FailedDuring:   map[string]int64{},
+		Phases:         []phaseRecord{},
+	}
+	for _, f := range setup.Failed {
+		record.FailedDuring[f.Phase] = f.Count
+	}
+	for _, p := range setup.Phases {
+		record.Phases = append(record.Phases, newPhaseRecord(p))
+	}
+	if setup.TLS != nil {
+		record.TLS = newTLSRecord(setup.TLS)
+	}
+	return record
+}
+
+func newPhaseRecord(p PhaseSummary) phaseRecord {
+	phase := phaseRecord{
+		Phase:       p.Phase,
+		Count:       p.Count,
+		MinNs:       p.Min.Nanoseconds(),
+		MeanNs:      p.Mean.Nanoseconds(),
+		MaxNs:       p.Max.Nanoseconds(),
+		Percentiles: map[string]int64{},
+	}
+	for _, value := range p.Percentiles {
+		phase.Percentiles["p"+formatPercentile(value.Percentile)] = value.Value.Nanoseconds()
+	}
+	return phase
+}
+
+// intervalRecord is the structured form of an IntervalReport
+type intervalRecord struct {
+	summaryRecord
+	StartNs int64 `json:"interval_start_ns"`
+	EndNs   int64 `json:"interval_end_ns"`
+}
+
+// binRecord is the structured form of a HistogramBin
+type binRecord struct {
+	LowerNs int64 `json:"lower_ns"`
+	UpperNs int64 `json:"upper_ns"`
+	Count   int64 `json:"count"`
+}
+
+func newSampleRecord(sample Sample) sampleRecord {
+	intended := ""
+	if !sample.IntendedTime.IsZero() {
+		intended = sample.IntendedTime.UTC().Format(time.RFC3339Nano)
+	}
+	return sampleRecord{
+		Type:          "sample",
+		SchemaVersion: resultSchemaVersion,
+		MessageID:     sample.MessageID,
+		Seq:           sample.Seq,
+		SendTime:      sample.SendTime.UTC().Format(time.RFC3339Nano),
+		RecvTime:      sample.RecvTime.UTC().Format(time.RFC3339Nano),
+		IntendedTime:  intended,
+		RTTNs:         sample.RTT.Nanoseconds(),
+		PayloadSize:   sample.PayloadSize,
+		ConnID:        sample.ConnID,
+		Target:        sample.Target,
+		SendTransfer:  sample.SendTransfer.Nanoseconds(),
+		RecvTransfer:  sample.RecvTransfer.Nanoseconds(),
+	}
+}
+
+func newSummaryRecord(summary Summary) summaryRecord {
+	record := summaryRecord{
+		Type:          "summary",
+		SchemaVersion: resultSchemaVersion,
+		Sent:          summary.Sent,
+		Count:         summary.Count,
+		Lost:          summary.Lost,
+		Late:          summary.Late,
+		InFlight:      summary.InFlight,
+		LossPercent:   summary.LossPercent(),
+		Duplicates:    summary.Duplicates,
+		Reordered:     summary.Reordered,
+		Gaps:          summary.Gaps,
+		Skipped:       summary.Skipped,
+		MinNs:         summary.Min.Nanoseconds(),
+		MaxNs:         summary.Max.Nanoseconds(),
+		MeanNs:        summary.Mean.Nanoseconds(),
+		StdDevNs:      summary.StdDev.Nanoseconds(),
+		MeanAbsDevNs:  summary.MeanAbsDev.Nanoseconds(),
+		JitterNs:      summary.Jitter.Nanoseconds(),
+		Percentiles:   make(map[string]int64),
+		Distribution:  []binRecord{},
+	}
+	for _, p := range summary.Percentiles {
+		record.Percentiles["p"+formatPercentile(p.Percentile)] = p.Value.Nanoseconds()
+	}
+	for _, bin := range summary.Distribution {
+		record.Distribution = append(record.Distribution, binRecord{
+			LowerNs: bin.Lower.Nanoseconds(),
+			UpperNs: bin.Upper.Nanoseconds(),
+			Count:   bin.Count,
+		})
+	}
+	for _, c := range summary.Connections {
+		connSummary := newSummaryRecord(c.Summary)
+		connSummary.Type = "connection"
+		record.Connections = append(record.Connections, connRecord{
+			ConnID:    c.ConnID,
+			NodeID:    c.NodeID,
+			LocalAddr: c.LocalAddr,
+			Summary:   connSummary,
+		})
+	}
+	if summary.Setup != nil {
+		record.Setup = newSetupRecord(summary.Setup)
+	}
+	for _, event := range summary.Disconnects {
+		record.Disconnects = append(record.Disconnects, newDisconnectRecord(event))
+	}
+	for _, t := range summary.Targets {
+		targetSummary := newSummaryRecord(t.Summary)
+		targetSummary.Type = "target"
+		target := targetRecord{
+			Name:        t.Target.Name,
+			URL:         t.Target.URL(),
+			Unreachable: t.Unreachable,
+			Summary:     targetSummary,
+		}
+		if t.Err != nil {
+			target.Error = t.Err.Error()
+		}
+		if t.Setup != nil {
+			target.Setup = newSetupRecord(t.Setup)
+		}
+		record.Targets = append(record.Targets, target)
+	}
+	for _, step := range summary.Steps {
+		stepSummary := newSummaryRecord(step.Summary)
+		stepSummary.Type = "step"
+		record.Steps = append(record.Steps, stepRecord{
+			Step:        step.Step,
+			Rate:        step.Load.Rate,
+			Connections: step.Load.Connections,
+			StartNs:     step.Start.Nanoseconds(),
+			EndNs:       step.End.Nanoseconds(),
+			Summary:     stepSummary,
+		})
+	}
+	if summary.Bulk != nil {
+		record.Bulk = newBulkRecord(summary.Bulk)
+	}
+	if summary.Compression != nil {
+		record.Compression = newCompressionRecord(summary.Compression)
+	}
+	for _, size := range summary.Sizes {
+		sizeSummary := newSummaryRecord(size.Summary)
+		sizeSummary.Type = "size"
+		record.Sizes = append(record.Sizes, sizeRecord{
+			PayloadSize: size.Size,
+			StartNs:     size.Start.Nanoseconds(),
+			EndNs:       size.End.Nanoseconds(),
+			Throughput:  size.Throughput(),
+			Summary:     sizeSummary,
+		})
+	}
+	return record
+}
+
+func newIntervalRecord(report IntervalReport) intervalRecord {
+	record := intervalRecord{
+		summaryRecord: newSummaryRecord(report.Summary),
+		StartNs:       report.Start.Nanoseconds(),
+		EndNs:         report.End.Nanoseconds(),
+	}
+	record.Type = "interval"
+	return record
+}
+
+// jsonResultWriter writes one JSON object per line
+type jsonResultWriter struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (j *jsonResultWriter) WriteSample(sample Sample) {
+	j.write(newSampleRecord(sample))
+}
+
+func (j *jsonResultWriter) WriteInterval(report IntervalReport) {
+	j.write(newIntervalRecord(report))
+	j.mu.Lock()
+	j.w.Flush()
+	j.mu.Unlock()
+}
+
+func (j *jsonResultWriter) WriteSummary(summary Summary) {
+	j.write(newSummaryRecord(summary))
+	j.mu.Lock()
+	j.w.Flush()
+	j.mu.Unlock()
+}
+
+func (j *jsonResultWriter) write(record interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Encode appends the trailing newline
+	j.encoder.Encode(record)
+}
+
+func (j *jsonResultWriter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.w.Flush()
+}
+
+// csvHeader lists the columns of every row. Sample rows fill the columns up
+// to recv_transfer_ns. Every other row type carries one metric per row in
+// the metric and value columns. Per-connection rows fill conn_id and
+// per-target rows fill target. Interval, profile step and sweep size rows
+// put their bounds, relative to the start of the run, in start_offset_ns
+// and end_offset_ns. Disconnect rows describe one dropped session each, in
+// conn_id, target, the session bounds and the columns after them. All other
+// columns are left empty so every row has the same number of fields.
+// Columns are only ever appended at the end.
+var csvHeader = []string{
+	"type", "schema_version", "message_id", "seq",
+	"send_time", "recv_time", "rtt_ns", "payload_size", "conn_id", "intended_time",
+	"target", "send_transfer_ns", "recv_transfer_ns",
+	"metric", "value", "start_offset_ns", "end_offset_ns",
+	"session", "remote_addr", "close_code", "reason", "downtime_ns", "reconnected", "attempts",
+}
+
+// Columns of the CSV rows that are not samples
+const (
+	csvConnIDColumn      = 8
+	csvTargetColumn      = 10
+	csvMetricColumn      = 13
+	csvValueColumn       = 14
+	csvStartColumn       = 15
+	csvEndColumn         = 16
+	csvSessionColumn     = 17
+	csvRemoteAddrColumn  = 18
+	csvCloseCodeColumn   = 19
+	csvReasonColumn      = 20
+	csvDowntimeColumn    = 21
+	csvReconnectedColumn = 22
+	csvAttemptsColumn    = 23
+)
+
+// csvResultWriter writes samples and summary metrics as CSV rows
+type csvResultWriter struct {
+	mu sync.Mutex
+	w  *csv.Writer
+}
+
+func newCSVResultWriter(out io.Writer) *csvResultWriter {
+	c := &csvResultWriter{w: csv.NewWriter(out)}
+	c.w.Write(csvHeader)
+	return c
+}
+
+func (c *csvResultWriter) WriteSample(sample Sample) {
+	record := newSampleRecord(sample)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.w.Write([]string{
+		record.Type,
+		strconv.Itoa(record.SchemaVersion),
+		record.MessageID,
+		strconv.FormatUint(record.Seq, 10),
+		record.SendTime,
+		record.RecvTime,
+		strconv.FormatInt(record.RTTNs, 10),
+		strconv.Itoa(record.PayloadSize),
+		strconv.Itoa(record.ConnID),
+		record.IntendedTime,
+		record.Target,
+		csvOptionalInt(record.SendTransfer),
+		csvOptionalInt(record.RecvTransfer),
+		"", "", "", "", "", "", "", "", "", "", "",
+	})
+}
+
+// csvOptionalInt formats a value that is left empty when zero
+func csvOptionalInt(value int64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+func (c *csvResultWriter) WriteInterval(report IntervalReport) {
+	record := newIntervalRecord(report)
+	c.writeMetrics(record.summaryRecord, report.Summary,
+		strconv.FormatInt(record.StartNs, 10), strconv.FormatInt(record.EndNs, 10), "", "")
+}
+
+func (c *csvResultWriter) WriteSummary(summary Summary) {
+	record := newSummaryRecord(summary)
+	c.writeMetrics(record, summary, "", "", "", "")
+	for i, conn := range summary.Connections {
+		c.writeMetrics(record.Connections[i].Summary, conn.Summary, "", "", strconv.Itoa(conn.ConnID), "")
+	}
+	for i, step := range summary.Steps {
+		c.writeMetrics(record.Steps[i].Summary, step.Summary,
+			strconv.FormatInt(record.Steps[i].StartNs, 10), strconv.FormatInt(record.Steps[i].EndNs, 10), "", "",
+			[2]string{"step", strconv.Itoa(step.Step)},
+			[2]string{"rate", strconv.FormatFloat(step.Load.Rate, 'f', -1, 64)},
+			[2]string{"connections", strconv.Itoa(step.Load.Connections)},
+		)
+	}
+	for i, size := range summary.Sizes {
+		c.writeMetrics(record.Sizes[i].Summary, size.Summary,
+			strconv.FormatInt(record.Sizes[i].StartNs, 10), strconv.FormatInt(record.Sizes[i].EndNs, 10), "", "",
+			[2]string{"payload_size", strconv.Itoa(size.Size)},
+			[2]string{"throughput_bytes_per_sec", strconv.FormatFloat(record.Sizes[i].Throughput, 'f', 1, 64)},
+		)
+	}
+	if record.Bulk != nil {
+		c.writeBulk(record.Bulk)
+	}
+	if record.Compression != nil {
+		c.writeCompression(record.Compression)
+	}
+	if record.Setup != nil {
+		c.writeSetup(record.Setup, "")
+	}
+	if len(record.Disconnects) > 0 {
+		c.writeDisconnects(record.Disconnects)
+	}
+	for i, t := range summary.Targets {
+		var extra [][2]string
+		if record.Targets[i].Error != "" {
+			extra = append(extra, [2]string{"error", record.Targets[i].Error})
+		}
+		if t.Unreachable {
+			extra = append(extra, [2]string{"unreachable", "true"})
+		}
+		c.writeMetrics(record.Targets[i].Summary, t.Summary, "", "", "", t.Target.Name, extra...)
+		if record.Targets[i].Setup != nil {
+			c.writeSetup(record.Targets[i].Setup, t.Target.Name)
+		}
+	}
+}
+
+// writeSetup writes one row per connection set up metric
+func (c *csvResultWriter) writeSetup(setup *setupRecord, target string) {
+	metrics := [][2]string{
+		{"attempts", strconv.FormatInt(setup.Attempts, 10)},
+		{"failures", strconv.FormatInt(setup.Failures, 10)},
+		{"failure_percent", strconv.FormatFloat(setup.FailurePercent, 'f', 3, 64)},
+	}
+	for _, name := range setupPhases {
+		if count, ok := setup.FailedDuring[name]; ok {
+			metrics = append(metrics, [2]string{csvPhaseName(name) + "_failures", strconv.FormatInt(count, 10)})
+		}
+	}
+	metrics = append(metrics, csvPhaseMetrics("", setup.Phases)...)
+	if t := setup.TLS; t != nil {
+		metrics = append(metrics,
+			[2]string{"tls_handshakes", strconv.FormatInt(t.Handshakes, 10)},
+			[2]string{"tls_resumed", strconv.FormatInt(t.Resumed, 10)},
+		)
+		metrics = append(metrics, csvTLSCounts("tls_version_", t.Versions)...)
+		metrics = append(metrics, csvTLSCounts("tls_cipher_", t.CipherSuites)...)
+		metrics = append(metrics, csvTLSCounts("tls_alpn_", t.ALPN)...)
+	}
+
+	c.writeRows("setup", metrics, target)
+}
+
+// writeBulk writes one row per bulk transfer metric
+func (c *csvResultWriter) writeBulk(bulk *bulkRecord) {
+	metrics := [][2]string{
+		{"direction", bulk.Direction},
+		{"payload_size", strconv.Itoa(bulk.PayloadSize)},
+		{"messages", strconv.FormatInt(bulk.Messages, 10)},
+		{"elapsed_ns", strconv.FormatInt(bulk.ElapsedNs, 10)},
+		{"sent_bytes", strconv.FormatInt(bulk.SentBytes, 10)},
+		{"received_bytes", strconv.FormatInt(bulk.RecvBytes, 10)},
+		{"upload_bytes_per_sec", strconv.FormatFloat(bulk.UploadRate, 'f', 1, 64)},
+		{"download_bytes_per_sec", strconv.FormatFloat(bulk.DownloadRate, 'f', 1, 64)},
+	}
+	if bulk.Direction == BulkEcho {
+		metrics = append(metrics, [2]string{"echo_bytes_per_sec", strconv.FormatFloat(bulk.EchoRate, 'f', 1, 64)})
+	}
+	metrics = append(metrics, csvPhaseMetrics("transfer_", bulk.Transfer)...)
+	c.writeRows("bulk", metrics, "")
+}
+
+// writeCompression writes one row per compression metric
+func (c *csvResultWriter) writeCompression(compression *compressionRecord) {
+	metrics := [][2]string{
+		{"level", strconv.Itoa(compression.Level)},
+		{"connections", strconv.FormatInt(compression.Connections, 10)},
+		{"negotiated", strconv.FormatInt(compression.Negotiated, 10)},
+		{"message_sent_bytes", strconv.FormatInt(compression.MessageSent, 10)},
+		{"socket_sent_bytes", strconv.FormatInt(compression.SocketSent, 10)},
+		{"sent_ratio", strconv.FormatFloat(compression.SentRatio, 'f', 3, 64)},
+		{"message_received_bytes", strconv.FormatInt(compression.MessageRecv, 10)},
+		{"socket_received_bytes", strconv.FormatInt(compression.SocketRecv, 10)},
+		{"received_ratio", strconv.FormatFloat(compression.RecvRatio, 'f', 3, 64)},
+		{"elapsed_ns", strconv.FormatInt(compression.ElapsedNs, 10)},
+		{"cpu_ns", strconv.FormatInt(compression.CPUNs, 10)},
+		{"cpu_per_message_ns", strconv.FormatInt(compression.CPUPerMessage, 10)},
+	}
+	metrics = append(metrics, csvPhaseMetrics("", compression.Cost)...)
+	c.writeRows("compression", metrics, "")
+}
+
+// csvPhaseMetrics turns phase distributions into metrics named after the
+// phase, after prefix
+func csvPhaseMetrics(prefix string, phases []phaseRecord) [][2]string {
+	var metrics [][2]string
+	for _, phase := range phases {
+		name := prefix + csvPhaseName(phase.Phase)
+		metrics = append(metrics,
+			[2]string{name + "_count", strconv.FormatInt(phase.Count, 10)},
+			[2]string{name + "_min_ns", strconv.FormatInt(phase.MinNs, 10)},
+			[2]string{name + "_mean_ns", strconv.FormatInt(phase.MeanNs, 10)},
+			[2]string{name + "_max_ns", strconv.FormatInt(phase.MaxNs, 10)},
+		)
+		for _, p := range reportedPercentiles {
+			key := "p" + formatPercentile(p)
+			metrics = append(metrics, [2]string{name + "_" + key + "_ns", strconv.FormatInt(phase.Percentiles[key], 10)})
+		}
+	}
+	return metrics
+}
+
+// writeRows writes one row of the given type per metric
+func (c *csvResultWriter) writeRows(rowType string, metrics [][2]string, target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, metric := range metrics {
+		row := make([]string, len(csvHeader))
+		row[0] = rowType
+		row[1] = strconv.Itoa(resultSchemaVersion)
+		row[csvTargetColumn] = target
+		row[csvMetricColumn] = metric[0]
+		row[csvValueColumn] = metric[1]
+		c.w.Write(row)
+	}
+	c.w.Flush()
+}
+
+// writeDisconnects writes one row per dropped connection
+func (c *csvResultWriter) writeDisconnects(events []disconnectRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, event := range events {
+		row := make([]string, len(csvHeader))
+		row[0] = "disconnect"
+		row[1] = strconv.Itoa(resultSchemaVersion)
+		row[csvConnIDColumn] = strconv.Itoa(event.ConnID)
+		row[csvTargetColumn] = event.Target
+		row[csvStartColumn] = strconv.FormatInt(event.StartNs, 10)
+		row[csvEndColumn] = strconv.FormatInt(event.EndNs, 10)
+		row[csvSessionColumn] = strconv.Itoa(event.Session)
+		row[csvRemoteAddrColumn] = event.RemoteAddr
+		row[csvCloseCodeColumn] = strconv.Itoa(event.CloseCode)
+		row[csvReasonColumn] = event.Reason
+		row[csvDowntimeColumn] = strconv.FormatInt(event.DowntimeNs, 10)
+		row[csvReconnectedColumn] = strconv.FormatBool(event.Reconnected)
+		row[csvAttemptsColumn] = strconv.Itoa(event.Attempts)
+		c.w.Write(row)
+	}
+	c.w.Flush()
+}
+
+// csvTLSCounts turns the counts of one TLS parameter into metrics, in a
+// stable order
+func csvTLSCounts(prefix string, counts map[string]int64) [][2]string {
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	metrics := make([][2]string, 0, len(values))
+	for _, value := range values {
+		metrics = append(metrics, [2]string{prefix + csvPhaseName(value), strconv.FormatInt(counts[value], 10)})
+	}
+	return metrics
+}
+
+// csvPhaseName turns a set up phase into a metric name prefix
+func csvPhaseName(phase string) string {
+	return strings.ReplaceAll(phase, " ", "_")
+}
+
+// writeMetrics writes one row per summary metric, after the extra rows
+func (c *csvResultWriter) writeMetrics(record summaryRecord, summary Summary, start, end, connID, target string,
+	extra ...[2]string) {
+	metrics := append(extra, [][2]string{
+		{"sent", strconv.FormatInt(record.Sent, 10)},
+		{"count", strconv.FormatInt(record.Count, 10)},
+		{"lost", strconv.FormatInt(record.Lost, 10)},
+		{"late", strconv.FormatInt(record.Late, 10)},
+		{"in_flight", strconv.FormatInt(record.InFlight, 10)},
+		{"loss_percent", strconv.FormatFloat(record.LossPercent, 'f', 3, 64)},
+		{"duplicates", strconv.FormatInt(record.Duplicates, 10)},
+		{"reordered", strconv.FormatInt(record.Reordered, 10)},
+		{"gaps", strconv.FormatInt(record.Gaps, 10)},
+		{"skipped", strconv.FormatInt(record.Skipped, 10)},
+		{"min_ns", strconv.FormatInt(record.MinNs, 10)},
+		{"max_ns", strconv.FormatInt(record.MaxNs, 10)},
+		{"mean_ns", strconv.FormatInt(record.MeanNs, 10)},
+		{"stddev_ns", strconv.FormatInt(record.StdDevNs, 10)},
+		{"mean_abs_dev_ns", strconv.FormatInt(record.MeanAbsDevNs, 10)},
+		{"jitter_ns", strconv.FormatInt(record.JitterNs, 10)},
+	}...)
+	for _, p := range summary.Percentiles {
+		name := "p" + formatPercentile(p.Percentile) + "_ns"
+		metrics = append(metrics, [2]string{name, strconv.FormatInt(p.Value.Nanoseconds(), 10)})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, metric := range metrics {
+		row := make([]string, len(csvHeader))
+		row[0] = record.Type
+		row[1] = strconv.Itoa(record.SchemaVersion)
+		row[csvConnIDColumn] = connID
+		row[csvTargetColumn] = target
+		row[csvMetricColumn] = metric[0]
+		row[csvValueColumn] = metric[1]
+		row[csvStartColumn] = start
+		row[csvEndColumn] = end
+		c.w.Write(row)
+	}
+	c.w.Flush()
+}
+
+func (c *csvResultWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runControl tells every connection of a run when to stop
+type runControl struct {
+	drainOnce sync.Once
+	abortOnce sync.Once
+
+	// drain is closed when no more messages should be sent; connections
+	// then wait for their outstanding replies before closing
+	drain chan struct{}
+	// abort is closed when connections should close right away
+	abort chan struct{}
+}
+
+func newRunControl() *runControl {
+	return &runControl{
+		drain: make(chan struct{}),
+		abort: make(chan struct{}),
+	}
+}
+
+// Drain stops sending on every connection
+func (c *runControl) Drain() {
+	c.drainOnce.Do(func() { close(c.drain) })
+}
+
+// Abort closes every connection
+func (c *runControl) Abort() {
+	c.abortOnce.Do(func() { close(c.abort) })
+}
+
+// probeConnection sends probe messages over a single WebSocket connection
+// and measures their round trip times
+type probeConnection struct {
+	id        int
+	nodeID    int64
+	target    string
+	label     string
+	config    Config
+	conn      *websocket.Conn
+	snowflake *Snowflake
+	logger    *BufferedLogger
+	results   ResultWriter
+	stats     *RTTStats
+
+	// Messages waiting for their echo, given up on after the per-message timeout
+	tracker *OutstandingTracker
+	// Sequence numbers of sent messages and of the echoes seen so far
+	nextSeq   uint64
+	sequences SequenceTracker
+
+	// Channel to coordinate message sending after receiving response
+	sendNext chan struct{}
+	// Channel signalled whenever an echo arrives, used while draining
+	replied chan struct{}
+
+	// session counts the connections made for this slot, starting at 1
+	session int
+	// readErr is why the read loop of the last session ended
+	readErr error
+	// stopping is set once the connection is closed on purpose
+	stopping bool
+
+	// setup gets the time to the first echo of every session, if set
+	setup  *SetupStats
+	echoed bool
+	// compression gets the size and cost of every message, if set
+	compression *CompressionStats
+}
+
+// newProbeConnection wraps an established connection. Statistics are
+// recorded in a child of stats.
+func newProbeConnection(id int, nodeID int64, conn *websocket.Conn, config Config, target string,
+	logger *BufferedLogger, results ResultWriter, stats *RTTStats) (*probeConnection, error) {
+	// Create a Snowflake ID generator
+	snowflake, err := NewSnowflake(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snowflake generator: %v", err)
+	}
+
+	// Only label log lines when there is more than one connection or target
+	label := connLabel(target, id, config.Connections > 1)
+
+	return &probeConnection{
+		id:        id,
+		nodeID:    nodeID,
+		target:    target,
+		label:     label,
+		config:    config,
+		conn:      conn,
+		snowflake: snowflake,
+		logger:    logger,
+		results:   results,
+		stats:     stats.NewChild(),
+		tracker:   NewOutstandingTracker(config.Timeout),
+		sendNext:  make(chan struct{}, 1),
+		replied:   make(chan struct{}, 1),
+		session:   1,
+	}, nil
+}
+
+// log writes a line to the buffered logger, labelled with the connection
+func (p *probeConnection) log(format string, args ...interface{}) {
+	p.logger.Write(p.label + fmt.Sprintf(format, args...))
+}
+
+// triggerSend asks the send loop for the next message without blocking
+func (p *probeConnection) triggerSend() {
+	select {
+	case p.sendNext <- struct{}{}:
+	default:
+	}
+}
+
+// window returns how many messages may be in flight at once, 0 meaning no
+// limit. Waiting for every reply is a window of 1.
+func (p *probeConnection) window() int {
+	switch {
+	case p.config.Rate > 0, p.config.NoWait:
+		return 0
+	case p.config.Window > 0:
+		return p.config.Window
+	default:
+		return 1
+	}
+}
+
+// windowed reports whether sending is paced by the replies
+func (p *probeConnection) windowed() bool {
+	return p.window() > 0
+}
+
+// windowOpen reports whether another message may be sent right away
+func (p *probeConnection) windowOpen() bool {
+	return p.window() == 0 || p.tracker.Pending() < p.window()
+}
+
+// sendPeriod is the time between two messages of an open-loop sender
+func (p *probeConnection) sendPeriod() time.Duration {
+	period := time.Duration(float64(time.Second) * float64(p.config.Connections) / p.config.Rate)
+	if period < 1 {
+		period = 1
+	}
+	return period
+}
+
+// Summary returns the statistics of this connection
+func (p *probeConnection) Summary() ConnectionSummary {
+	summary := p.stats.Summary()
+	summary.InFlight = int64(p.tracker.Pending())
+	return ConnectionSummary{
+		ConnID:    p.id,
+		NodeID:    p.nodeID,
+		LocalAddr: p.conn.LocalAddr().String(),
+		Summary:   summary,
+	}
+}
+
+// readLoop reads echoes from the server until the connection is closed
+func (p *probeConnection) readLoop(done chan<- struct{}) {
+	defer func() {
+		// Give up on overdue messages so they show up as lost
+		p.stats.RecordLost(p.tracker.Expire(time.Now()))
+		close(done)
+	}()
+
+	for {
+		messageType, serverMessage, err := p.readMessage()
+		if err != nil {
+			p.readErr = err
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return
+			}
+			p.log("Error reading message: %v", err)
+			return
+		}
+
+		switch messageType {
+		case websocket.TextMessage, websocket.BinaryMessage:
+			msg, err := decodeMessage(messageType, serverMessage)
+			if err != nil {
+				p.log("Error parsing message: %v", err)
+				continue
+			}
+			p.handleEcho(msg)
+		case websocket.PingMessage:
+			// Received a ping from the server, send back a pong
+			err := p.conn.WriteMessage(websocket.PongMessage, nil)
+			if err != nil {
+				p.log("Error sending pong response: %v", err)
+				return // Exit the read loop if pong fails
+			}
+			p.log("Received ping, sent pong.")
+		}
+	}
+}
+
+// readMessage reads the next message. With compression statistics it is
+// timed from its first byte, which includes inflating it.
+func (p *probeConnection) readMessage() (int, []byte, error) {
+	if p.compression == nil {
+		return p.conn.ReadMessage()
+	}
+	messageType, reader, err := p.conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	readStart := time.Now()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return messageType, nil, err
+	}
+	p.compression.RecordRead(len(data), time.Since(readStart))
+	return messageType, data, nil
+}
+
+// handleEcho accounts for a message echoed by the server
+func (p *probeConnection) handleEcho(msg Message) {
+	// Calculate round-trip time with nanosecond precision
+	now := time.Now().UTC()
+	rtt := now.Sub(msg.Timestamp)
+	sendTime := msg.Timestamp
+	var intended time.Time
+
+	pending, status := p.tracker.Complete(msg.MessageID)
+	if status == replyLate {
+		// Already counted as lost, and the next message already went out.
+		// Its sequence number is noted but not counted as out of order.
+		if msg.Seq != 0 {
+			p.sequences.Observe(msg.Seq)
+		}
+		p.stats.RecordLate()
+		p.log("Late reply: %d us (ID: %s)", rtt.Microseconds(), msg.MessageID)
+		return
+	}
+
+	// Servers predating sequence numbers echo none back
+	if msg.Seq != 0 {
+		event, skipped := p.sequences.Observe(msg.Seq)
+		if event == sequenceGap {
+			// Messages that already timed out are counted as lost, not skipped
+			skipped -= p.tracker.ExpiredBetween(msg.Seq-skipped, msg.Seq-1)
+			if skipped == 0 {
+				event = sequenceInOrder
+			}
+		}
+		p.stats.RecordSequence(event, skipped)
+		switch event {
+		case sequenceDuplicate:
+			p.log("Duplicate reply: seq %d (ID: %s)", msg.Seq, msg.MessageID)
+			return
+		case sequenceReordered:
+			p.log("Out of order reply: seq %d (ID: %s)", msg.Seq, msg.MessageID)
+		case sequenceGap:
+			p.log("Sequence gap: %d message(s) missing before seq %d", skipped, msg.Seq)
+		}
+	}
+
+	if status == replyUnknown {
+		p.log("Unexpected reply (ID: %s)", msg.MessageID)
+		return
+	}
+
+	// Measure from the send time kept by the tracker, so the RTT of every
+	// message stays exact however many are in flight
+	sendTime = pending.SendTime
+	rtt = now.Sub(sendTime)
+
+	// The first echo completes the set up of the session
+	if p.setup != nil && !p.echoed {
+		p.echoed = true
+		p.setup.RecordFirstEcho(rtt)
+	}
+
+	// An open-loop sender measures from the scheduled send time, so time
+	// spent waiting behind a stalled connection is not hidden
+	if p.config.Rate > 0 {
+		intended = pending.Intended
+		rtt = now.Sub(intended)
+	}
+
+	// Update statistics
+	p.stats.Record(p.target, p.id, rtt)
+
+	// log.Printf("Received: %s (ID: %s)", msg.Content, msg.MessageID)
+	p.results.WriteSample(Sample{
+		Target:       p.target,
+		ConnID:       p.id,
+		MessageID:    msg.MessageID,
+		Seq:          msg.Seq,
+		SendTime:     sendTime,
+		RecvTime:     now,
+		IntendedTime: intended,
+		RTT:          rtt,
+		PayloadSize:  len(msg.Content),
+	})
+
+	if p.windowed() {
+		// A slot in the window is free, signal to send the next message
+		p.triggerSend()
+	}
+
+	select {
+	case p.replied <- struct{}{}:
+	default:
+	}
+}
+
+// send writes the next probe message. intended is the time it was scheduled
+// for, or zero if it is sent right away.
+func (p *probeConnection) send(intended time.Time) error {
+	// Generate a message ID using Snowflake algorithm
+	snowflakeID, err := p.snowflake.NextID()
+	if err != nil {
+		log.Printf("Error generating snowflake ID: %v", err)
+		return nil
+	}
+	messageID := fmt.Sprintf("%d", snowflakeID)
+
+	// Generate random content
+	content := generatePayload(p.config.PayloadSize, p.config.Compressibility, generateRandomString)
+
+	// Create message with current timestamp
+	p.nextSeq++
+	msg := Message{
+		Timestamp: time.Now().UTC(),
+		Content:   content,
+		MessageID: messageID,
+		Seq:       p.nextSeq,
+	}
+
+	// Encode the message as JSON or in the binary format
+	frameType, data, err := encodeMessage(msg, p.config.Encoding)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return nil
+	}
+
+	if intended.IsZero() {
+		intended = msg.Timestamp
+	}
+
+	// Send the message, tracking it first so a fast echo is never unknown
+	p.tracker.Add(messageID, msg.Seq, msg.Timestamp, intended)
+	writeStart := time.Now()
+	if err := p.conn.WriteMessage(frameType, data); err != nil {
+		log.Printf("Error sending message: %v", err)
+		return err
+	}
+	if p.compression != nil {
+		p.compression.RecordWrite(len(data), time.Since(writeStart))
+	}
+	p.stats.RecordSent()
+
+	// log.Printf("Sent message: %s (ID: %s)", content, messageID)
+	return nil
+}
+
+// closeAndWait performs the close handshake and waits for the server to finish it
+func (p *probeConnection) closeAndWait(done <-chan struct{}) error {
+	// Send close message to server (optional but polite)
+	err := p.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		return fmt.Errorf("write close: %v", err)
+	}
+
+	// Wait for the server to close the connection
+	select {
+	case <-done:
+		// Connection closed by server
+	case <-time.After(5 * time.Second):
+		// Timed out waiting for server to close
+	}
+
+	return nil
+}
+
+// run sends messages until the server goes away or the run is stopped
+func (p *probeConnection) run(control *runControl) error {
+	done := make(chan struct{})
+	go p.readLoop(done)
+	defer func() {
+		p.conn.Close()
+		<-done
+	}()
+
+	// Periodically give up on messages whose echo is overdue
+	expireInterval := p.config.Timeout / 10
+	if expireInterval < 10*time.Millisecond {
+		expireInterval = 10 * time.Millisecond
+	}
+	expireTicker := time.NewTicker(expireInterval)
+	defer expireTicker.Stop()
+
+	// Once a limit is hit no more messages are sent, and the connection is
+	// closed when every outstanding message is either echoed or timed out
+	draining := false
+	drain := control.drain
+	startDraining := func(reason string) {
+		p.stopping = true
+		draining = true
+		drain = nil
+		p.log("%s, waiting for %d outstanding replies", reason, p.tracker.Pending())
+	}
+
+	// An open-loop sender follows an absolute schedule, regardless of the
+	// replies. Connections are spread over the period to avoid bursts.
+	var schedule <-chan time.Time
+	var scheduleTimer *time.Timer
+	var next time.Time
+	if p.config.Rate > 0 {
+		period := p.sendPeriod()
+		next = time.Now().Add(period * time.Duration(p.id) / time.Duration(p.config.Connections))
+		scheduleTimer = time.NewTimer(time.Until(next))
+		defer scheduleTimer.Stop()
+		schedule = scheduleTimer.C
+	} else {
+		// Send the first message to start the cycle
+		p.triggerSend()
+	}
+
+	// Main loop for sending messages
+	for {
+		if draining && p.tracker.Pending() == 0 {
+			return p.closeAndWait(done)
+		}
+
+		select {
+		case <-p.sendNext:
+			if draining {
+				continue
+			}
+
+			if err := p.send(time.Time{}); err != nil {
+				return err
+			}
+
+			if p.config.Count > 0 && p.nextSeq >= p.config.Count {
+				startDraining(fmt.Sprintf("Sent %d messages", p.nextSeq))
+				continue
+			}
+
+			if p.windowOpen() {
+				// Signal to send the next message
+				p.triggerSend()
+			}
+
+			// Small delay to prevent flooding the connection
+			time.Sleep(time.Duration(p.config.Interval) * time.Millisecond)
+
+		case <-schedule:
+			if draining {
+				schedule = nil
+				continue
+			}
+
+			intended := next
+			next = next.Add(p.sendPeriod())
+			if err := p.send(intended); err != nil {
+				return err
+			}
+
+			if p.config.Count > 0 && p.nextSeq >= p.config.Count {
+				startDraining(fmt.Sprintf("Sent %d messages", p.nextSeq))
+				schedule = nil
+				continue
+			}
+
+			// When behind schedule the timer fires right away, catching up
+			scheduleTimer.Reset(time.Until(next))
+
+		case now := <-expireTicker.C:
+			if lost := p.tracker.Expire(now); lost > 0 {
+				p.stats.RecordLost(lost)
+				p.log("Reply timed out for %d message(s)", lost)
+
+				// Stop waiting for the echo and carry on with the next message
+				if p.windowed() && p.windowOpen() {
+					p.triggerSend()
+				}
+			}
+
+		case <-p.replied:
+			// Loop around to check whether draining is complete
+
+		case <-drain:
+			startDraining("Stopped sending")
+
+		case <-done:
+			return nil
+
+		case <-control.abort:
+			p.stopping = true
+			return p.closeAndWait(done)
+		}
+	}
+}
+
+// resume continues on a new connection after the previous one dropped
+func (p *probeConnection) resume(conn *websocket.Conn) {
+	p.conn = conn
+	p.session++
+	p.readErr = nil
+	p.echoed = false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadStep is one step of a load profile. A zero Rate keeps the send mode
+// chosen with -interval and -nowait.
+type LoadStep struct {
+	Rate        float64 `json:"rate"`
+	Connections int     `json:"connections"`
+}
+
+// String describes the load of the step
+func (s LoadStep) String() string {
+	if s.Rate > 0 {
+		return fmt.Sprintf("%g msg/s x %d", s.Rate, s.Connections)
+	}
+	return fmt.Sprintf("closed loop x %d", s.Connections)
+}
+
+// StepSummary is the summary of one step of a load profile. Start and End
+// are offsets from the start of the run.
+type StepSummary struct {
+	Step    int
+	Load    LoadStep
+	Start   time.Duration
+	End     time.Duration
+	Summary Summary
+}
+
+// parseProfile parses a load profile spec: a comma separated list of steps,
+// each written as RATE[xCONNS]. Either RATE or CONNS may be a ramp written
+// as FROM-TO/STEP, which expands to one step per increment. Steps without
+// CONNS use defaultConns.
+//
+// For example "100,200,400x2" or "100-1000/100x4" or "0x1-16/5".
+func parseProfile(spec string, defaultConns int) ([]LoadStep, error) {
+	var steps []LoadStep
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		ratePart, connPart, hasConns := strings.Cut(item, "x")
+
+		rates, err := parseProfileRange(ratePart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate in profile step '%s': %v", item, err)
+		}
+		conns := []float64{float64(defaultConns)}
+		if hasConns {
+			conns, err = parseProfileRange(connPart)
+			if err != nil {
+				return nil, fmt.Errorf("invalid connections in profile step '%s': %v", item, err)
+			}
+		}
+		if len(rates) > 1 && len(conns) > 1 {
+			return nil, fmt.Errorf("profile step '%s' ramps both rate and connections", item)
+		}
+
+		for _, rate := range rates {
+			for _, c := range conns {
+				if c != float64(int(c)) || c < 1 || c > 1024 {
+					return nil, fmt.Errorf("connections in profile step '%s' must be whole numbers between 1 and 1024", item)
+				}
+				steps = append(steps, LoadStep{Rate: rate, Connections: int(c)})
+			}
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("profile has no steps")
+	}
+	return steps, nil
+}
+
+// parseProfileRange parses a single non-negative number or a FROM-TO/STEP ramp
+func parseProfileRange(s string) ([]float64, error) {
+	if s == "" {
+		return nil, fmt.Errorf("missing value")
+	}
+
+	dash := strings.IndexByte(s, '-')
+	if dash < 0 {
+		value, err := parseProfileNumber(s)
+		if err != nil {
+			return nil, err
+		}
+		return []float64{value}, nil
+	}
+
+	slash := strings.IndexByte(s, '/')
+	if slash < dash {
+		return nil, fmt.Errorf("ramp must be written as FROM-TO/STEP")
+	}
+	from, err := parseProfileNumber(s[:dash])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseProfileNumber(s[dash+1 : slash])
+	if err != nil {
+		return nil, err
+	}
+	increment, err := parseProfileNumber(s[slash+1:])
+	if err != nil {
+		return nil, err
+	}
+	if increment == 0 || to < from {
+		return nil, fmt.Errorf("ramp must go up by a positive step")
+	}
+
+	// The tolerance keeps TO in the ramp when the steps do not add up to it
+	// exactly in floating point, as with 0.1-0.3/0.1
+	steps := math.Floor((to-from)/increment + 1e-9)
+	if steps >= 1000 {
+		return nil, fmt.Errorf("ramp has more than 1000 steps")
+	}
+	values := make([]float64, 0, int(steps)+1)
+	for i := 0; i <= int(steps); i++ {
+		values = append(values, min(from+float64(i)*increment, to))
+	}
+	return values, nil
+}
+
+// parseProfileNumber parses a finite non-negative number
+func parseProfileNumber(s string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("'%s' is not a finite non-negative number", s)
+	}
+	return value, nil
+}
+
+// formatStepLine renders the result of a profile step in one line
+func formatStepLine(step StepSummary, total int) string {
+	return fmt.Sprintf("Step %d/%d (%s): %s",
+		step.Step, total, step.Load,
+		formatIntervalLine(IntervalReport{Start: step.Start, End: step.End, Summary: step.Summary}),
+	)
+}
+
+// printStepTable writes one row of statistics per profile step
+func printStepTable(w io.Writer, steps []StepSummary) {
+	fmt.Fprintf(w, "\nPer-step statistics (us):\n")
+	fmt.Fprintf(w, "    %4s %10s %5s %8s %7s %7s %6s %8s %8s %8s %8s %8s\n",
+		"Step", "Rate", "Conns", "Achieved", "Sent", "Recv", "Loss%",
+		"Avg", "p50", "p90", "p99", "Max")
+	for _, step := range steps {
+		s := step.Summary
+		rate := "closed"
+		if step.Load.Rate > 0 {
+			rate = strconv.FormatFloat(step.Load.Rate, 'g', -1, 64)
+		}
+		// The rate at which echoes came back shows whether the server kept up
+		achieved := 0.0
+		if length := (step.End - step.Start).Seconds(); length > 0 {
+			achieved = float64(s.Count) / length
+		}
+		fmt.Fprintf(w, "    %4d %10s %5d %8.1f %7d %7d %6.1f %8d %8d %8d %8d %8d\n",
+			step.Step, rate, step.Load.Connections, achieved,
+			s.Sent, s.Count, s.LossPercent(),
+			s.Mean.Microseconds(),
+			s.Percentile(50).Microseconds(),
+			s.Percentile(90).Microseconds(),
+			s.Percentile(99).Microseconds(),
+			s.Max.Microseconds(),
+		)
+	}
+}
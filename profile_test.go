@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []LoadStep
+		wantErr bool
+	}{
+		{spec: "100", want: []LoadStep{{100, 2}}},
+		{spec: "100,200,400x3", want: []LoadStep{{100, 2}, {200, 2}, {400, 3}}},
+		{spec: " 100 , ,200 ", want: []LoadStep{{100, 2}, {200, 2}}},
+		{spec: "0.5", want: []LoadStep{{0.5, 2}}},
+		{spec: "0x4", want: []LoadStep{{0, 4}}},
+		{spec: "100-400/100", want: []LoadStep{{100, 2}, {200, 2}, {300, 2}, {400, 2}}},
+		{spec: "100-350/100x4", want: []LoadStep{{100, 4}, {200, 4}, {300, 4}}},
+		{spec: "0.1-0.3/0.1", want: []LoadStep{{0.1, 2}, {0.2, 2}, {0.3, 2}}},
+		{spec: "0.5-2/0.5", want: []LoadStep{{0.5, 2}, {1, 2}, {1.5, 2}, {2, 2}}},
+		{spec: "0x1-16/5", want: []LoadStep{{0, 1}, {0, 6}, {0, 11}, {0, 16}}},
+		{spec: "50x1024", want: []LoadStep{{50, 1024}}},
+		{spec: "", wantErr: true},
+		{spec: ",", wantErr: true},
+		{spec: "abc", wantErr: true},
+		{spec: "-5", wantErr: true},
+		{spec: "NaN", wantErr: true},
+		{spec: "Inf", wantErr: true},
+		{spec: "100-inf/1", wantErr: true},
+		{spec: "100x", wantErr: true},
+		{spec: "100x0", wantErr: true},
+		{spec: "100x1.5", wantErr: true},
+		{spec: "100x1025", wantErr: true},
+		{spec: "100-200/10x1-4/1", wantErr: true},
+		{spec: "100-200", wantErr: true},
+		{spec: "100/10-200", wantErr: true},
+		{spec: "200-100/10", wantErr: true},
+		{spec: "100-200/0", wantErr: true},
+		{spec: "0-1001/1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseProfile(tt.spec, 2)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseProfile(%q) = %v, want error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseProfile(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxy schemes the client can dial through. socks5h is the same as socks5,
+// which always leaves resolving the target to the proxy.
+const (
+	ProxyHTTP    = "http"
+	ProxyHTTPS   = "https"
+	ProxySOCKS5  = "socks5"
+	ProxySOCKS5H = "socks5h"
+)
+
+// SOCKS5 authentication methods, as in RFC 1928 and RFC 1929
+const (
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+)
+
+// socks5Replies describes the SOCKS5 reply codes
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// parseProxyURL parses a proxy URL, http://[user:pass@]host[:port],
+// https://[user:pass@]host[:port] or socks5://[user:pass@]host[:port]
+func parseProxyURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL '%s': %v", value, err)
+	}
+	return u, checkProxyURL(u)
+}
+
+// checkProxyURL fails unless the client can dial through the proxy
+func checkProxyURL(u *url.URL) error {
+	switch u.Scheme {
+	case ProxyHTTP, ProxyHTTPS, ProxySOCKS5, ProxySOCKS5H:
+	default:
+		return fmt.Errorf("invalid proxy URL '%s': scheme must be http, https, socks5 or socks5h", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid proxy URL '%s': missing host", u.Redacted())
+	}
+	return nil
+}
+
+// targetProxy returns the proxy to reach a target through: the -proxy URL
+// if given, otherwise the one the environment picks for it, or nil to
+// connect directly
+func targetProxy(proxy string, target Target) (*url.URL, error) {
+	if proxy != "" {
+		return parseProxyURL(proxy)
+	}
+	return proxyFromEnvironment(os.Getenv, target)
+}
+
+// proxyFromEnvironment returns the proxy the environment picks for a
+// target, or nil to connect directly. wss targets use HTTPS_PROXY and ws
+// targets HTTP_PROXY, both falling back to ALL_PROXY, unless NO_PROXY
+// matches the target. Like net/http, localhost is never proxied and a
+// value without a scheme is taken as an HTTP proxy. Lowercase names are
+// read when the uppercase ones are unset.
+func proxyFromEnvironment(getenv func(string) string, target Target) (*url.URL, error) {
+	lookup := func(name string) (string, string) {
+		if value := getenv(name); value != "" {
+			return name, value
+		}
+		lower := strings.ToLower(name)
+		return lower, getenv(lower)
+	}
+
+	primary := "HTTP_PROXY"
+	if target.UseTLS {
+		primary = "HTTPS_PROXY"
+	}
+	name, value := lookup(primary)
+	if value == "" {
+		name, value = lookup("ALL_PROXY")
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	host, port, err := net.SplitHostPort(target.Addr)
+	if err != nil {
+		host, port = strings.Trim(target.Addr, "[]"), "80"
+		if target.UseTLS {
+			port = "443"
+		}
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" || net.ParseIP(host).IsLoopback() {
+		return nil, nil
+	}
+	if _, noProxy := lookup("NO_PROXY"); matchNoProxy(noProxy, host, port) {
+		return nil, nil
+	}
+
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := parseProxyURL(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return u, nil
+}
+
+// matchNoProxy reports whether a NO_PROXY value exempts host and port. Each
+// comma separated entry is *, an IP address or CIDR block, or a domain with
+// an optional port. A domain matches itself and its subdomains, and one with
+// a leading dot or *. only its subdomains.
+func matchNoProxy(value, host, port string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(strings.ToLower(value), ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		}
+		if _, block, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && block.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		entryHost = strings.Trim(entryHost, "[]")
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		if strings.HasPrefix(entryHost, ".") {
+			if strings.HasSuffix(host, entryHost) {
+				return true
+			}
+		} else if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyAddr returns the host and port of a proxy, with the default port of
+// its scheme if it has none
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	port := "80"
+	switch proxy.Scheme {
+	case ProxyHTTPS:
+		port = "443"
+	case ProxySOCKS5, ProxySOCKS5H:
+		port = "1080"
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// proxyDialContext returns a NetDialContext that connects to the proxy with
+// dial, so the DNS and connect phases time the proxy, and then has it open a
+// tunnel to the target, which the trace in ctx times as the proxy phase. An
+// https proxy is spoken to over TLS with tlsConfig, or the system roots if
+// it is nil. The connection reports the target as its remote address.
+func proxyDialContext(proxy *url.URL, tlsConfig *tls.Config,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, proxyAddr(proxy))
+		if err != nil {
+			return nil, err
+		}
+
+		t, traced := ctx.Value(setupTraceKey{}).(*setupTrace)
+		if traced {
+			t.mark(&t.proxyStart)
+		}
+		// Give up on the tunnel when the dial times out
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+
+		switch proxy.Scheme {
+		case ProxySOCKS5, ProxySOCKS5H:
+			err = socks5Connect(conn, proxy.User, addr)
+		case ProxyHTTPS:
+			config := &tls.Config{}
+			if tlsConfig != nil {
+				config = tlsConfig.Clone()
+			}
+			if config.ServerName == "" {
+				config.ServerName = proxy.Hostname()
+			}
+			tlsConn := tls.Client(conn, config)
+			conn = tlsConn
+			if err = tlsConn.HandshakeContext(ctx); err == nil {
+				err = httpConnect(conn, proxy.User, addr)
+			}
+		default:
+			err = httpConnect(conn, proxy.User, addr)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s proxy %s: %v", proxy.Scheme, proxyAddr(proxy), err)
+		}
+		if traced {
+			t.mark(&t.proxyDone)
+		}
+		return &tunnelConn{Conn: conn, target: addr}, nil
+	}
+}
+
+// tunnelConn is a connection tunnelled through a proxy. Its remote address
+// is the target at the far end of the tunnel rather than the proxy.
+type tunnelConn struct {
+	net.Conn
+	target string
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return tunnelAddr(c.target)
+}
+
+// tunnelAddr is the host and port of a tunnel's target, which the proxy
+// may not have resolved
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "tcp"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to addr with CONNECT, using
+// basic authentication if user is set
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	req.Header.Set("User-Agent", GetUserAgent())
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The proxy sends nothing after its response until the tunnel is used,
+	// so the reader cannot swallow any of the tunnel
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect asks a SOCKS5 proxy for a tunnel to addr, authenticating
+// with a username and password if user is set. Host names are passed on to
+// the proxy to resolve.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s'", portText)
+	}
+
+	// Greeting, offering username and password only when we have them
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = append(methods, socks5UserPass)
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != 5 {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", choice[0])
+	}
+	switch choice[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if err := socks5Authenticate(conn, user); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		if user == nil {
+			return fmt.Errorf("proxy requires authentication")
+		}
+		return fmt.Errorf("proxy accepts none of the offered authentication methods")
+	default:
+		return fmt.Errorf("proxy chose unsupported authentication method %d", choice[1])
+	}
+
+	// Connect request
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 1)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply ends with the address the proxy bound, which we skip
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		reason, ok := socks5Replies[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply %d", reply[1])
+		}
+		return fmt.Errorf("connect %s: %s", addr, reason)
+	}
+	var bound int64
+	switch reply[3] {
+	case 1:
+		bound = net.IPv4len
+	case 4:
+		bound = net.IPv6len
+	case 3:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		bound = int64(length[0])
+	default:
+		return fmt.Errorf("unknown bound address type %d", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, bound+2)
+	return err
+}
+
+// socks5Authenticate sends the username and password of user, as in RFC 1929
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	if user == nil {
+		return fmt.Errorf("proxy asked for a username and password")
+	}
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("username or password too long")
+	}
+
+	request := []byte{1, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0 {
+		return fmt.Errorf("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a TCP server that echoes everything back and
+// returns its address
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// pipe copies between two connections until either side closes
+func pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// connectProxy is an HTTP CONNECT proxy that tunnels every request to
+// upstream, whatever address it asks for. It answers with status instead
+// when status is not 200, and with 407 when credentials are set and the
+// request does not carry them.
+func connectProxy(upstream, credentials string, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if credentials != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)) {
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		target, err := net.Dial("tcp", upstream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		buffered.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		buffered.Flush()
+		pipe(conn, target)
+	})
+}
+
+// socks5Request is what a client asked the test SOCKS5 proxy to connect to
+type socks5Request struct {
+	addrType byte
+	host     string
+	port     uint16
+}
+
+// startSOCKS5 starts a minimal SOCKS5 proxy that answers every connect
+// request with reply and, on success, tunnels it to upstream. It requires
+// the username and password if user is set. The requests it gets are sent
+// on the returned channel.
+func startSOCKS5(t *testing.T, user, password string, reply byte, upstream string) (string, <-chan socks5Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan socks5Request, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, user, password, reply, upstream, requests)
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func serveSOCKS5(conn net.Conn, user, password string, reply byte, upstream string, requests chan<- socks5Request) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	// Greeting and method selection
+	greeting := readBytes(2)
+	if greeting == nil || greeting[0] != 5 {
+		return
+	}
+	methods := readBytes(int(greeting[1]))
+	want := byte(socks5NoAuth)
+	if user != "" {
+		want = socks5UserPass
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		conn.Write([]byte{5, socks5NoAcceptable})
+		return
+	}
+	conn.Write([]byte{5, want})
+	if user != "" {
+		header := readBytes(2)
+		gotUser := string(readBytes(int(header[1])))
+		gotPassword := string(readBytes(int(readBytes(1)[0])))
+		if gotUser != user || gotPassword != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Connect request
+	header := readBytes(4)
+	if header == nil || header[1] != 1 {
+		return
+	}
+	request := socks5Request{addrType: header[3]}
+	switch header[3] {
+	case 1:
+		request.host = net.IP(readBytes(net.IPv4len)).String()
+	case 4:
+		request.host = net.IP(readBytes(net.IPv6len)).String()
+	case 3:
+		request.host = string(readBytes(int(readBytes(1)[0])))
+	}
+	request.port = binary.BigEndian.Uint16(readBytes(2))
+	requests <- request
+
+	conn.Write([]byte{5, reply, 0, 1, 127, 0, 0, 1, 0, 0})
+	if reply != 0 {
+		return
+	}
+	target, err := net.Dial("tcp", upstream)
+	if err != nil {
+		return
+	}
+	pipe(conn, target)
+}
+
+// dialThrough opens a tunnel to addr through the proxy
+func dialThrough(t *testing.T, proxy string, tlsConfig *tls.Config, addr string) (net.Conn, error) {
+	t.Helper()
+	u, err := parseProxyURL(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &net.Dialer{}
+	conn, err := proxyDialContext(u, tlsConfig, dialer.DialContext)(ctx, "tcp", addr)
+	if err == nil && conn.RemoteAddr().String() != addr {
+		t.Errorf("RemoteAddr = %s, want the target %s", conn.RemoteAddr(), addr)
+	}
+	return conn, err
+}
+
+// checkTunnel fails unless bytes written to conn come back
+func checkTunnel(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("tunnel echoed %q, want \"ping\"", reply)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	upstream := startEchoServer(t)
+
+	tests := []struct {
+		name        string
+		credentials string
+		status      int
+		userinfo    string
+		wantErr     string
+	}{
+		{name: "no auth", status: http.StatusOK},
+		{name: "user and password", credentials: "alice:secret", status: http.StatusOK, userinfo: "alice:secret@"},
+		{name: "missing credentials", credentials: "alice:secret", status: http.StatusOK, wantErr: "407"},
+		{name: "wrong password", credentials: "alice:secret", status: http.StatusOK, userinfo: "alice:wrong@", wantErr: "407"},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: "403 Forbidden"},
+		{name: "bad gateway", status: http.StatusBadGateway, wantErr: "502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(connectProxy(upstream, tt.credentials, tt.status))
+			defer server.Close()
+
+			proxy := "http://" + tt.userinfo + server.Listener.Addr().String()
+			conn, err := dialThrough(t, proxy, nil, "example.com:80")
+			if tt.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dial succeeded, want error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %q does not contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTunnel(t, conn)
+		})
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	upstream := startEchoServer(t)
+	server := httptest.NewTLSServer(connectProxy(upstream, "alice:secret", http.StatusOK))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	proxy := "https://alice:secret@" + server.Listener.Addr().String()
+
+	conn, err := dialThrough(t, proxy, &tls.Config{RootCAs: roots}, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTunnel(t, conn)
+
+	// Without the test CA the proxy certificate is not trusted
+	if conn, err := dialThrough(t, proxy, &tls.Config{RootCAs: x509.NewCertPool()}, "example.com:443"); err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded with an untrusted proxy certificate")
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	upstream := startEchoServer(t)
+
+	tests := []struct {
+		name     string
+		scheme   string
+		user     string
+		password string
+		userinfo string
+		addr     string
+		wantType byte
+		wantHost string
+		wantErr  string
+	}{
+		{name: "domain", scheme: "socks5", addr: "example.com:443", wantType: 3, wantHost: "example.com"},
+		{name: "ipv4", scheme: "socks5", addr: "192.0.2.7:8080", wantType: 1, wantHost: "192.0.2.7"},
+		{name: "ipv6", scheme: "socks5", addr: "[2001:db8::1]:8080", wantType: 4, wantHost: "2001:db8::1"},
+		{name: "socks5h", scheme: "socks5h", addr: "example.com:443", wantType: 3, wantHost: "example.com"},
+		{name: "user and password", scheme: "socks5", user: "alice", password: "secret", userinfo: "alice:secret@",
+			addr: "example.com:443", wantType: 3, wantHost: "example.com"},
+		{name: "wrong password", scheme: "socks5", user: "alice", password: "secret", userinfo: "alice:wrong@",
+			addr: "example.com:443", wantErr: "authentication failed"},
+		{name: "missing credentials", scheme: "socks5", user: "alice", password: "secret",
+			addr: "example.com:443", wantErr: "proxy requires authentication"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyAddr, requests := startSOCKS5(t, tt.user, tt.password, 0, upstream)
+			conn, err := dialThrough(t, tt.scheme+"://"+tt.userinfo+proxyAddr, nil, tt.addr)
+			if tt.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dial succeeded, want error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %q does not contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTunnel(t, conn)
+
+			request := <-requests
+			_, port, _ := net.SplitHostPort(tt.addr)
+			if request.addrType != tt.wantType || request.host != tt.wantHost || strconv.Itoa(int(request.port)) != port {
+				t.Errorf("proxy got type %d %s:%d, want type %d %s:%s",
+					request.addrType, request.host, request.port, tt.wantType, tt.wantHost, port)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Replies(t *testing.T) {
+	upstream := startEchoServer(t)
+
+	for code := byte(1); code <= 9; code++ {
+		want, ok := socks5Replies[code]
+		if !ok {
+			want = "reply " + strconv.Itoa(int(code))
+		}
+		t.Run(want, func(t *testing.T) {
+			proxyAddr, _ := startSOCKS5(t, "", "", code, upstream)
+			conn, err := dialThrough(t, "socks5://"+proxyAddr, nil, "example.com:443")
+			if err == nil {
+				conn.Close()
+				t.Fatalf("dial succeeded, want error containing %q", want)
+			}
+			if !strings.Contains(err.Error(), want) {
+				t.Fatalf("error %q does not contain %q", err, want)
+			}
+		})
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantAddr string
+		wantErr  bool
+	}{
+		{value: "http://proxy.example.com", wantAddr: "proxy.example.com:80"},
+		{value: "http://proxy.example.com:3128", wantAddr: "proxy.example.com:3128"},
+		{value: "https://proxy.example.com", wantAddr: "proxy.example.com:443"},
+		{value: "socks5://127.0.0.1", wantAddr: "127.0.0.1:1080"},
+		{value: "socks5h://user:pass@[::1]:9050", wantAddr: "[::1]:9050"},
+		{value: "ftp://proxy.example.com", wantErr: true},
+		{value: "http://", wantErr: true},
+		{value: "http://%zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			u, err := parseProxyURL(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseProxyURL(%q) succeeded, want error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := proxyAddr(u); got != tt.wantAddr {
+				t.Errorf("proxyAddr = %s, want %s", got, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		target  Target
+		want    string
+		wantErr string
+	}{
+		{name: "unset", target: Target{Addr: "example.com:80"}},
+		{name: "http for ws", env: map[string]string{"HTTP_PROXY": "http://p:3128", "HTTPS_PROXY": "http://s:3128"},
+			target: Target{Addr: "example.com:80"}, want: "http://p:3128"},
+		{name: "https for wss", env: map[string]string{"HTTP_PROXY": "http://p:3128", "HTTPS_PROXY": "http://s:3128"},
+			target: Target{Addr: "example.com:443", UseTLS: true}, want: "http://s:3128"},
+		{name: "lowercase", env: map[string]string{"https_proxy": "http://s:3128"},
+			target: Target{Addr: "example.com:443", UseTLS: true}, want: "http://s:3128"},
+		{name: "all proxy fallback", env: map[string]string{"HTTP_PROXY": "http://p:3128", "ALL_PROXY": "socks5h://a:1080"},
+			target: Target{Addr: "example.com:443", UseTLS: true}, want: "socks5h://a:1080"},
+		{name: "no scheme", env: map[string]string{"HTTP_PROXY": "p:3128"},
+			target: Target{Addr: "example.com:80"}, want: "http://p:3128"},
+		{name: "localhost", env: map[string]string{"HTTP_PROXY": "http://p:3128"},
+			target: Target{Addr: "localhost:8080"}},
+		{name: "loopback", env: map[string]string{"HTTP_PROXY": "http://p:3128"},
+			target: Target{Addr: "[::1]:8080"}},
+		{name: "no proxy domain", env: map[string]string{"HTTP_PROXY": "http://p:3128", "NO_PROXY": "internal, example.com"},
+			target: Target{Addr: "gw.example.com:80"}},
+		{name: "no proxy lowercase", env: map[string]string{"HTTP_PROXY": "http://p:3128", "no_proxy": "example.com"},
+			target: Target{Addr: "example.com:80"}},
+		{name: "no proxy other host", env: map[string]string{"HTTP_PROXY": "http://p:3128", "NO_PROXY": "example.org"},
+			target: Target{Addr: "example.com:80"}, want: "http://p:3128"},
+		{name: "bad https proxy", env: map[string]string{"HTTPS_PROXY": "ftp://p"},
+			target: Target{Addr: "example.com:443", UseTLS: true}, wantErr: "HTTPS_PROXY"},
+		{name: "bad all proxy", env: map[string]string{"ALL_PROXY": "http://%zz"},
+			target: Target{Addr: "example.com:80"}, wantErr: "ALL_PROXY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(name string) string { return tt.env[name] }
+			u, err := proxyFromEnvironment(getenv, tt.target)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if u != nil {
+				got = u.String()
+			}
+			if got != tt.want {
+				t.Errorf("proxy %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		host    string
+		port    string
+		want    bool
+	}{
+		{"", "example.com", "443", false},
+		{"*", "example.com", "443", true},
+		{"example.com", "example.com", "443", true},
+		{"example.com", "gw.example.com", "443", true},
+		{"example.com", "badexample.com", "443", false},
+		{".example.com", "example.com", "443", false},
+		{".example.com", "gw.example.com", "443", true},
+		{"*.example.com", "gw.example.com", "443", true},
+		{"*.example.com", "example.com", "443", false},
+		{"EXAMPLE.com", "example.com", "443", true},
+		{"example.com:8443", "example.com", "443", false},
+		{"example.com:443", "example.com", "443", true},
+		{"10.0.0.0/8", "10.1.2.3", "80", true},
+		{"10.0.0.0/8", "192.0.2.1", "80", false},
+		{"10.0.0.0/8", "ten.example.com", "80", false},
+		{"192.0.2.1", "192.0.2.1", "80", true},
+		{"192.0.2.1:8080", "192.0.2.1", "80", false},
+		{"2001:db8::1", "2001:db8::1", "80", true},
+		{"[2001:db8::1]:80", "2001:db8::1", "80", true},
+		{"2001:db8::/32", "2001:db8::7", "80", true},
+		{"a.com, ,b.com", "b.com", "80", true},
+	}
+	for _, tt := range tests {
+		if got := matchNoProxy(tt.noProxy, tt.host, tt.port); got != tt.want {
+			t.Errorf("matchNoProxy(%q, %s, %s) = %v, want %v", tt.noProxy, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
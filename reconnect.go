@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// reconnectBaseDelay is the backoff before the first reconnect attempt
+const reconnectBaseDelay = 250 * time.Millisecond
+
+// DisconnectEvent describes a connection session that dropped and how long
+// it took to get the connection back. Start, End and offsets are relative
+// to the start of the run.
+type DisconnectEvent struct {
+	Target     string
+	ConnID     int
+	Session    int
+	RemoteAddr string
+	Start      time.Duration
+	End        time.Duration
+	// CloseCode is the code of the close frame sent by the server, or 0
+	// if the connection dropped without one
+	CloseCode int
+	Reason    string
+	// Downtime lasts until the connection was back, or until the run
+	// stopped if it never came back
+	Downtime    time.Duration
+	Reconnected bool
+	Attempts    int
+}
+
+// Disconnects returns the dropped connections so far, in the order they dropped
+func (r *clientRun) Disconnects() []DisconnectEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]DisconnectEvent(nil), r.disconnects...)
+}
+
+// keepConnected runs the connection until the run is stopped. With
+// -reconnect a dropped connection is dialed again with exponential backoff,
+// carrying on with the same statistics; without it the connection ends.
+func (r *clientRun) keepConnected(p *probeConnection, control *runControl) error {
+	for {
+		start := time.Since(r.started)
+		err := p.run(control)
+		if !r.config.Reconnect || p.stopping {
+			return err
+		}
+
+		event := DisconnectEvent{
+			Target:     r.target.Name,
+			ConnID:     p.id,
+			Session:    p.session,
+			RemoteAddr: p.conn.RemoteAddr().String(),
+			Start:      start,
+			End:        time.Since(r.started),
+		}
+		switch closeErr, ok := p.readErr.(*websocket.CloseError); {
+		case ok:
+			event.CloseCode = closeErr.Code
+			event.Reason = closeErr.Text
+		case p.readErr != nil:
+			event.Reason = p.readErr.Error()
+		case err != nil:
+			event.Reason = err.Error()
+		}
+		p.log("Disconnected from %s after %s: %s", event.RemoteAddr,
+			(event.End - event.Start).Truncate(time.Millisecond), formatDisconnectReason(event))
+
+		// Whatever was in flight went down with the connection
+		p.stats.RecordLost(p.tracker.ExpireAll(time.Now()))
+		r.dashboard.SetState("reconnecting")
+
+		conn, attempts := r.redial(p, control)
+		event.Attempts = attempts
+		event.Reconnected = conn != nil
+		event.Downtime = time.Since(r.started) - event.End
+		r.mu.Lock()
+		r.disconnects = append(r.disconnects, event)
+		r.mu.Unlock()
+
+		if conn == nil {
+			return nil
+		}
+		p.resume(conn)
+		p.log("Reconnected to WebSocket server (%s -> %s) after %s, session %d",
+			conn.LocalAddr(), conn.RemoteAddr(), event.Downtime.Truncate(time.Millisecond), p.session)
+		r.dashboard.SetState("connected")
+	}
+}
+
+// redial dials the connection of p again until it succeeds or the run is
+// stopped, backing off exponentially with jitter between attempts and
+// honouring Retry-After on 429 and 503 responses up to -reconnect-max. It
+// returns the new connection, nil if the run was stopped first, and the
+// number of attempts.
+func (r *clientRun) redial(p *probeConnection, control *runControl) (*websocket.Conn, int) {
+	var retryAfter time.Duration
+	for attempt := 0; ; attempt++ {
+		delay := reconnectDelay(attempt, retryAfter, r.config.ReconnectMax)
+		select {
+		case <-time.After(delay):
+		case <-control.drain:
+			return nil, attempt
+		case <-control.abort:
+			return nil, attempt
+		}
+
+		conn, resp, err := r.dialConn(p.id)
+		if err == nil {
+			return conn, attempt + 1
+		}
+
+		retryAfter = parseRetryAfter(resp)
+		if retryAfter > 0 {
+			p.log("Reconnect attempt %d failed: %v, retrying after %s as asked by the server", attempt+1, err,
+				reconnectDelay(attempt+1, retryAfter, r.config.ReconnectMax))
+		} else {
+			p.log("Reconnect attempt %d failed: %v", attempt+1, err)
+		}
+	}
+}
+
+// reconnectDelay returns the delay before the given reconnect attempt: the
+// Retry-After delay asked for by the server, capped at max so a server
+// cannot stall the connection for longer than the backoff would, or else
+// the backoff delay
+func reconnectDelay(attempt int, retryAfter, max time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, max)
+	}
+	return backoffDelay(attempt, max)
+}
+
+// backoffDelay returns the delay before the given reconnect attempt: the
+// base delay doubled for every previous attempt, capped at max, with up to
+// half of it taken off at random so connections do not retry in lockstep
+func backoffDelay(attempt int, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 30 && reconnectBaseDelay<<uint(attempt) < max {
+		delay = reconnectBaseDelay << uint(attempt)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter returns the delay asked for by the Retry-After header of a
+// 429 or 503 response, or 0 if there is none
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	// Either a number of seconds or an HTTP date. Seconds too many for a
+	// Duration are ignored rather than wrapped around.
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 || seconds > int64(math.MaxInt64/time.Second) {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// formatDisconnectReason describes why a connection dropped
+func formatDisconnectReason(event DisconnectEvent) string {
+	switch {
+	case event.CloseCode != 0 && event.Reason != "":
+		return fmt.Sprintf("close %d (%s)", event.CloseCode, event.Reason)
+	case event.CloseCode != 0:
+		return fmt.Sprintf("close %d", event.CloseCode)
+	case event.Reason != "":
+		return event.Reason
+	default:
+		return "connection closed"
+	}
+}
+
+// printDisconnects writes the log of dropped connections
+func printDisconnects(w io.Writer, events []DisconnectEvent) {
+	var downtime time.Duration
+	for _, event := range events {
+		downtime += event.Downtime
+	}
+
+	fmt.Fprintf(w, "\nDisconnects: %d, total downtime %s\n", len(events), downtime.Truncate(time.Millisecond))
+	fmt.Fprintf(w, "    %-12s %4s %7s  %-21s %10s %10s %10s %8s  %s\n",
+		"Target", "Conn", "Session", "Remote address", "Up at", "Down at", "Downtime", "Attempts", "Reason")
+	for _, event := range events {
+		target := event.Target
+		if target == "" {
+			target = "-"
+		}
+		reason := formatDisconnectReason(event)
+		if !event.Reconnected {
+			reason += ", not reconnected"
+		}
+		fmt.Fprintf(w, "    %-12s %4d %7d  %-21s %9.1fs %9.1fs %10s %8d  %s\n",
+			target, event.ConnID, event.Session, event.RemoteAddr,
+			event.Start.Seconds(), event.End.Seconds(),
+			event.Downtime.Truncate(time.Millisecond), event.Attempts, reason,
+		)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		status  int
+		value   string
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "delta seconds", status: http.StatusServiceUnavailable, value: "5", wantMin: 5 * time.Second, wantMax: 5 * time.Second},
+		{name: "zero seconds", status: http.StatusServiceUnavailable, value: "0"},
+		{name: "too many requests", status: http.StatusTooManyRequests, value: "120", wantMin: 2 * time.Minute, wantMax: 2 * time.Minute},
+		{name: "HTTP date", status: http.StatusServiceUnavailable, value: now.Add(30 * time.Second).UTC().Format(http.TimeFormat),
+			wantMin: 28 * time.Second, wantMax: 30 * time.Second},
+		{name: "RFC 850 date", status: http.StatusTooManyRequests, value: now.Add(time.Hour).UTC().Format(time.RFC850),
+			wantMin: 59 * time.Minute, wantMax: time.Hour},
+		{name: "date in the past", status: http.StatusServiceUnavailable, value: now.Add(-time.Minute).UTC().Format(http.TimeFormat)},
+		{name: "missing", status: http.StatusServiceUnavailable},
+		{name: "negative", status: http.StatusServiceUnavailable, value: "-5"},
+		{name: "fraction", status: http.StatusServiceUnavailable, value: "1.5"},
+		{name: "garbage", status: http.StatusServiceUnavailable, value: "soon"},
+		{name: "too large", status: http.StatusServiceUnavailable, value: "99999999999"},
+		{name: "other status", status: http.StatusBadGateway, value: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+			if tt.value != "" {
+				resp.Header.Set("Retry-After", tt.value)
+			}
+			got := parseRetryAfter(resp)
+			if got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("parseRetryAfter(%d, %q) = %v, want %v to %v", tt.status, tt.value, got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+
+	if got := parseRetryAfter(nil); got != 0 {
+		t.Errorf("parseRetryAfter(nil) = %v, want 0", got)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	max := 30 * time.Second
+
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter time.Duration
+		wantMin    time.Duration
+		wantMax    time.Duration
+	}{
+		{name: "first backoff", wantMin: reconnectBaseDelay / 2, wantMax: reconnectBaseDelay},
+		{name: "third backoff", attempt: 2, wantMin: 2 * reconnectBaseDelay, wantMax: 4 * reconnectBaseDelay},
+		{name: "backoff capped", attempt: 20, wantMin: max / 2, wantMax: max},
+		{name: "backoff past the shift limit", attempt: 100, wantMin: max / 2, wantMax: max},
+		{name: "retry after", attempt: 5, retryAfter: 5 * time.Second, wantMin: 5 * time.Second, wantMax: 5 * time.Second},
+		{name: "retry after capped", retryAfter: time.Hour, wantMin: max, wantMax: max},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := reconnectDelay(tt.attempt, tt.retryAfter, max)
+			if got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("reconnectDelay(%d, %v, %v) = %v, want %v to %v", tt.attempt, tt.retryAfter, max, got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
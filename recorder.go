@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record file formats accepted by the -record-format flag
+const (
+	RecordJSONL  = "jsonl"
+	RecordBinary = "binary"
+)
+
+// recordMagic starts every binary record file
+const recordMagic = "WSRTTREC"
+
+// recordVersion is the version of the record file layout
+const recordVersion = 2
+
+// binaryRecordSize is the size of one sample in a binary record file:
+// message ID, seq, send time, receive time, RTT, intended send offset
+// (int64 each), payload size, connection ID and target index (uint32 each),
+// all little endian. The intended send offset is how long after its
+// scheduled time the message was sent, 0 if it was not scheduled, and the
+// target index points into the targets of the header's config.
+const binaryRecordSize = 6*8 + 3*4
+
+// redactedHeaders are never written to record files
+var redactedHeaders = []string{"authorization", "proxy-authorization", "cookie"}
+
+// recordHeader is written once at the start of a record file
+type recordHeader struct {
+	Type          string    `json:"type"`
+	SchemaVersion int       `json:"schema_version"`
+	Version       string    `json:"version"`
+	StartTime     time.Time `json:"start_time"`
+	Config        Config    `json:"config"`
+}
+
+// recordSample is one JSON Lines sample entry
+type recordSample struct {
+	Type        string `json:"type"`
+	MessageID   string `json:"message_id"`
+	Seq         uint64 `json:"seq"`
+	ConnID      int    `json:"conn_id"`
+	Target      string `json:"target,omitempty"`
+	SendTimeNs  int64  `json:"send_time_ns"`
+	RecvTimeNs  int64  `json:"recv_time_ns"`
+	IntendedNs  int64  `json:"intended_time_ns,omitempty"`
+	RTTNs       int64  `json:"rtt_ns"`
+	PayloadSize int    `json:"payload_size"`
+	SendNs      int64  `json:"send_transfer_ns,omitempty"`
+	RecvNs      int64  `json:"recv_transfer_ns,omitempty"`
+}
+
+// SampleRecorder streams every raw sample of a run to a file.
+// It implements ResultWriter so it can sit next to the regular output.
+type SampleRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	format string
+	err    error
+	// targets maps target names to their index in the binary records
+	targets map[string]int
+}
+
+// NewSampleRecorder creates the record file and writes its header
+func NewSampleRecorder(path, format string, config Config) (*SampleRecorder, error) {
+	if format != RecordJSONL && format != RecordBinary {
+		return nil, fmt.Errorf("unknown record format '%s' (expected jsonl or binary)", format)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create record file: %v", err)
+	}
+
+	r := &SampleRecorder{
+		f:       f,
+		w:       bufio.NewWriterSize(f, 64*1024),
+		format:  format,
+		targets: make(map[string]int, len(config.Targets)),
+	}
+	for i, target := range config.Targets {
+		r.targets[target.Name] = i
+	}
+
+	header := recordHeader{
+		Type:          "header",
+		SchemaVersion: recordVersion,
+		Version:       GetVersionInfo(),
+		StartTime:     time.Now().UTC(),
+		Config:        redactConfig(config),
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to encode record header: %v", err)
+	}
+
+	if format == RecordBinary {
+		r.w.WriteString(recordMagic)
+		binary.Write(r.w, binary.LittleEndian, uint16(recordVersion))
+		binary.Write(r.w, binary.LittleEndian, uint32(len(headerJSON)))
+		r.w.Write(headerJSON)
+	} else {
+		r.w.Write(headerJSON)
+		r.w.WriteByte('\n')
+	}
+
+	return r, nil
+}
+
+// redactConfig drops credentials from the headers and the proxy URL before
+// they hit the disk
+func redactConfig(config Config) Config {
+	headers := make(map[string]string, len(config.Headers))
+	for name, value := range config.Headers {
+		for _, redacted := range redactedHeaders {
+			if strings.ToLower(name) == redacted {
+				value = "[redacted]"
+				break
+			}
+		}
+		headers[name] = value
+	}
+	config.Headers = headers
+	if proxy, err := url.Parse(config.Proxy); err == nil && config.Proxy != "" {
+		config.Proxy = proxy.Redacted()
+	}
+
+	targets := make([]Target, len(config.Targets))
+	for i, target := range config.Targets {
+		target.Headers = redactConfig(Config{Headers: target.Headers}).Headers
+		targets[i] = target
+	}
+	if len(targets) > 0 {
+		config.Targets = targets
+	}
+	return config
+}
+
+// WriteSample appends a sample to the record file
+func (r *SampleRecorder) WriteSample(sample Sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	if r.format == RecordBinary {
+		// Snowflake IDs are numeric, so they fit in an int64
+		messageID, _ := strconv.ParseInt(sample.MessageID, 10, 64)
+
+		var intendedOffset time.Duration
+		if !sample.IntendedTime.IsZero() {
+			intendedOffset = sample.SendTime.Sub(sample.IntendedTime)
+		}
+
+		var buf [binaryRecordSize]byte
+		binary.LittleEndian.PutUint64(buf[0:], uint64(messageID))
+		binary.LittleEndian.PutUint64(buf[8:], sample.Seq)
+		binary.LittleEndian.PutUint64(buf[16:], uint64(sample.SendTime.UnixNano()))
+		binary.LittleEndian.PutUint64(buf[24:], uint64(sample.RecvTime.UnixNano()))
+		binary.LittleEndian.PutUint64(buf[32:], uint64(sample.RTT.Nanoseconds()))
+		binary.LittleEndian.PutUint64(buf[40:], uint64(intendedOffset.Nanoseconds()))
+		binary.LittleEndian.PutUint32(buf[48:], uint32(sample.PayloadSize))
+		binary.LittleEndian.PutUint32(buf[52:], uint32(sample.ConnID))
+		binary.LittleEndian.PutUint32(buf[56:], uint32(r.targets[sample.Target]))
+		_, r.err = r.w.Write(buf[:])
+		return
+	}
+
+	var intended int64
+	if !sample.IntendedTime.IsZero() {
+		intended = sample.IntendedTime.UnixNano()
+	}
+	line, err := json.Marshal(recordSample{
+		Type:        "sample",
+		MessageID:   sample.MessageID,
+		Seq:         sample.Seq,
+		ConnID:      sample.ConnID,
+		Target:      sample.Target,
+		SendTimeNs:  sample.SendTime.UnixNano(),
+		RecvTimeNs:  sample.RecvTime.UnixNano(),
+		IntendedNs:  intended,
+		RTTNs:       sample.RTT.Nanoseconds(),
+		PayloadSize: sample.PayloadSize,
+		SendNs:      sample.SendTransfer.Nanoseconds(),
+		RecvNs:      sample.RecvTransfer.Nanoseconds(),
+	})
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.w.Write(line)
+	r.err = r.w.WriteByte('\n')
+}
+
+// WriteInterval ignores reporting windows, they can be rebuilt from the samples
+func (r *SampleRecorder) WriteInterval(report IntervalReport) {
+}
+
+// WriteSummary appends the run summary as a trailer to JSON Lines files.
+// Binary files hold samples only; the summary can be rebuilt from them.
+func (r *SampleRecorder) WriteSummary(summary Summary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil || r.format == RecordBinary {
+		return
+	}
+
+	line, err := json.Marshal(newSummaryRecord(summary))
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.w.Write(line)
+	r.err = r.w.WriteByte('\n')
+}
+
+// Close flushes and closes the record file, reporting the first write error
+func (r *SampleRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if err := r.f.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if r.err != nil {
+		return fmt.Errorf("failed to write record file: %v", r.err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSampleRecorderBinaryLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.bin")
+	config := Config{Targets: []Target{{Name: "eu"}, {Name: "us"}}}
+	recorder, err := NewSampleRecorder(path, RecordBinary, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := time.Unix(1000, 0)
+	recorder.WriteSample(Sample{
+		Target:       "us",
+		ConnID:       3,
+		MessageID:    "-2",
+		Seq:          7,
+		IntendedTime: send.Add(-5 * time.Millisecond),
+		SendTime:     send,
+		RecvTime:     send.Add(time.Millisecond),
+		RTT:          6 * time.Millisecond,
+		PayloadSize:  32,
+	})
+	// A closed-loop sample has no intended time
+	recorder.WriteSample(Sample{Target: "eu", SendTime: send, RecvTime: send, PayloadSize: 16})
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(recordMagic)) {
+		t.Fatalf("file starts with %q, want %q", data[:len(recordMagic)], recordMagic)
+	}
+	data = data[len(recordMagic):]
+	if version := binary.LittleEndian.Uint16(data); version != recordVersion {
+		t.Errorf("version = %d, want %d", version, recordVersion)
+	}
+	data = data[6+binary.LittleEndian.Uint32(data[2:]):]
+	if len(data) != 2*binaryRecordSize {
+		t.Fatalf("%d bytes of samples, want %d", len(data), 2*binaryRecordSize)
+	}
+
+	var want []byte
+	want = binary.LittleEndian.AppendUint64(want, 0xfffffffffffffffe)
+	want = binary.LittleEndian.AppendUint64(want, 7)
+	want = binary.LittleEndian.AppendUint64(want, uint64(send.UnixNano()))
+	want = binary.LittleEndian.AppendUint64(want, uint64(send.Add(time.Millisecond).UnixNano()))
+	want = binary.LittleEndian.AppendUint64(want, uint64(6*time.Millisecond))
+	want = binary.LittleEndian.AppendUint64(want, uint64(5*time.Millisecond))
+	want = binary.LittleEndian.AppendUint32(want, 32)
+	want = binary.LittleEndian.AppendUint32(want, 3)
+	want = binary.LittleEndian.AppendUint32(want, 1)
+	if got := data[:binaryRecordSize]; !bytes.Equal(got, want) {
+		t.Errorf("first record = % x, want % x", got, want)
+	}
+
+	second := data[binaryRecordSize:]
+	if offset := binary.LittleEndian.Uint64(second[40:]); offset != 0 {
+		t.Errorf("intended send offset without a schedule = %d, want 0", offset)
+	}
+	if target := binary.LittleEndian.Uint32(second[56:]); target != 0 {
+		t.Errorf("target index = %d, want 0", target)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+// sequenceWindow is how many sequence numbers below the highest one seen are
+// remembered for duplicate detection. Must be a multiple of 64.
+const sequenceWindow = 4096
+
+// sequenceEvent classifies a reply by its sequence number
+type sequenceEvent int
+
+const (
+	// sequenceInOrder is the next expected sequence number
+	sequenceInOrder sequenceEvent = iota
+	// sequenceGap skipped one or more sequence numbers
+	sequenceGap
+	// sequenceReordered is lower than a sequence number already seen
+	sequenceReordered
+	// sequenceDuplicate was already seen
+	sequenceDuplicate
+)
+
+// SequenceTracker classifies replies as in order, gaps, reordered or
+// duplicates based on the sequence number echoed by the server.
+// It is not safe for concurrent use.
+type SequenceTracker struct {
+	highest uint64
+	seen    [sequenceWindow / 64]uint64
+}
+
+// Observe records a sequence number and returns how it relates to the ones
+// seen before. For gaps it also returns how many sequence numbers were skipped.
+func (t *SequenceTracker) Observe(seq uint64) (sequenceEvent, uint64) {
+	if seq > t.highest {
+		// Forget the slots the window slides over
+		advance := seq - t.highest
+		if advance >= sequenceWindow {
+			t.seen = [sequenceWindow / 64]uint64{}
+		} else {
+			for s := t.highest + 1; s <= seq; s++ {
+				t.clear(s)
+			}
+		}
+
+		skipped := advance - 1
+		t.highest = seq
+		t.mark(seq)
+		if skipped > 0 {
+			return sequenceGap, skipped
+		}
+		return sequenceInOrder, 0
+	}
+
+	if t.highest-seq >= sequenceWindow {
+		// Too old to tell whether it is a duplicate
+		return sequenceReordered, 0
+	}
+	if t.isMarked(seq) {
+		return sequenceDuplicate, 0
+	}
+	t.mark(seq)
+	return sequenceReordered, 0
+}
+
+func (t *SequenceTracker) mark(seq uint64) {
+	slot := seq % sequenceWindow
+	t.seen[slot/64] |= 1 << (slot % 64)
+}
+
+func (t *SequenceTracker) clear(seq uint64) {
+	slot := seq % sequenceWindow
+	t.seen[slot/64] &^= 1 << (slot % 64)
+}
+
+func (t *SequenceTracker) isMarked(seq uint64) bool {
+	slot := seq % sequenceWindow
+	return t.seen[slot/64]&(1<<(slot%64)) != 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestSequenceTrackerObserve(t *testing.T) {
+	type observation struct {
+		seq     uint64
+		event   sequenceEvent
+		skipped uint64
+	}
+	inOrder := func(seq uint64) observation { return observation{seq, sequenceInOrder, 0} }
+
+	tests := []struct {
+		name         string
+		observations []observation
+	}{
+		{name: "in order", observations: []observation{
+			inOrder(1), inOrder(2), inOrder(3),
+		}},
+		{name: "gap then late reply", observations: []observation{
+			inOrder(1), {4, sequenceGap, 2}, {2, sequenceReordered, 0}, {3, sequenceReordered, 0}, inOrder(5),
+		}},
+		{name: "duplicates", observations: []observation{
+			inOrder(1), inOrder(2), {2, sequenceDuplicate, 0}, {1, sequenceDuplicate, 0}, inOrder(3),
+		}},
+		{name: "reordered reply seen twice", observations: []observation{
+			inOrder(1), {3, sequenceGap, 1}, {2, sequenceReordered, 0}, {2, sequenceDuplicate, 0},
+		}},
+		{name: "oldest remembered duplicate", observations: []observation{
+			inOrder(1), {sequenceWindow, sequenceGap, sequenceWindow - 2}, {1, sequenceDuplicate, 0},
+		}},
+		{name: "too old to tell", observations: []observation{
+			inOrder(1), {sequenceWindow + 1, sequenceGap, sequenceWindow - 1}, {1, sequenceReordered, 0},
+		}},
+		{name: "slot reused after the window slides", observations: []observation{
+			// sequenceWindow+4 shares the slot of 4, which must not count as seen,
+			// while 6 is still in the window and was seen
+			inOrder(1), inOrder(2), inOrder(3), inOrder(4), inOrder(5), inOrder(6),
+			{sequenceWindow + 5, sequenceGap, sequenceWindow - 2},
+			{sequenceWindow + 4, sequenceReordered, 0}, {6, sequenceDuplicate, 0}, {5, sequenceReordered, 0},
+		}},
+		{name: "jump past the whole window", observations: []observation{
+			inOrder(1), inOrder(2), {3 * sequenceWindow, sequenceGap, 3*sequenceWindow - 3},
+			{3*sequenceWindow - 10, sequenceReordered, 0}, {3*sequenceWindow - 10, sequenceDuplicate, 0},
+		}},
+		{name: "wraps the bitmap many times", observations: func() []observation {
+			var observations []observation
+			for seq := uint64(1); seq <= 3*sequenceWindow+5; seq++ {
+				observations = append(observations, inOrder(seq))
+			}
+			return append(observations,
+				observation{3*sequenceWindow + 5, sequenceDuplicate, 0},
+				observation{2*sequenceWindow + 6, sequenceDuplicate, 0},
+				observation{2*sequenceWindow + 5, sequenceReordered, 0},
+			)
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tracker SequenceTracker
+			for i, o := range tt.observations {
+				event, skipped := tracker.Observe(o.seq)
+				if event != o.event || skipped != o.skipped {
+					t.Fatalf("observation %d: Observe(%d) = %d, %d skipped, want %d, %d skipped",
+						i, o.seq, event, skipped, o.event, o.skipped)
+				}
+			}
+		})
+	}
+}
@@ -1,14 +1,79 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Behaviors a server route can have, chosen with -route
+const (
+	RouteEcho   = "echo"
+	RouteSink   = "sink"
+	RouteClose  = "close"
+	RouteReject = "reject"
+)
+
+// healthCheckPath is served by the health check endpoint, not a route
+const healthCheckPath = "/ping"
+
+// Route binds a server path to a behavior. Paths follow http.ServeMux
+// patterns, so a trailing slash matches the whole subtree.
+type Route struct {
+	Path     string `json:"path"`
+	Behavior string `json:"behavior"`
+}
+
+// serverRoutes returns the routes of the server, with the echo handler on
+// every path not routed otherwise
+func serverRoutes(routes []Route) []Route {
+	for _, route := range routes {
+		// A route that conflicts with / matches every path already
+		if registerPatterns(route.Path, "/") != nil {
+			return routes
+		}
+	}
+	return append(routes, Route{Path: "/", Behavior: RouteEcho})
+}
+
+// checkRoute fails unless path is a valid http.ServeMux pattern that
+// conflicts with neither the health check nor any of the routes, which
+// would make the server panic at startup
+func checkRoute(path string, routes []Route) error {
+	if err := registerPatterns(path); err != nil {
+		return fmt.Errorf("invalid route path: %v", err)
+	}
+	if registerPatterns(healthCheckPath, path) != nil {
+		return fmt.Errorf("route %s conflicts with the health check %s", path, healthCheckPath)
+	}
+	for _, route := range routes {
+		if registerPatterns(route.Path, path) != nil {
+			return fmt.Errorf("route %s conflicts with route %s: both match some paths and neither is more specific", path, route.Path)
+		}
+	}
+	return nil
+}
+
+// registerPatterns registers the patterns on a throwaway ServeMux and
+// returns what it panics with, if a pattern is invalid or two conflict
+func registerPatterns(patterns ...string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux := http.NewServeMux()
+	for _, pattern := range patterns {
+		mux.HandleFunc(pattern, handleHealthCheck)
+	}
+	return nil
+}
+
 var upgrader = websocket.Upgrader{
 	// Allow all origins for this demo
 	CheckOrigin: func(r *http.Request) bool {
@@ -17,17 +82,31 @@ var upgrader = websocket.Upgrader{
 }
 
 func startServer(config Config) error {
+	// Offer permessage-deflate to clients that ask for it
+	upgrader.EnableCompression = config.Compress
+	// Pick the first of our subprotocols the client offers
+	upgrader.Subprotocols = config.Subprotocols
+
 	// Create a new ServeMux to handle routes
 	mux := http.NewServeMux()
 
 	// Add health check endpoint for load balancer
-	mux.HandleFunc("/ping", handleHealthCheck)
+	mux.HandleFunc(healthCheckPath, handleHealthCheck)
 
-	// Set the default handler for all other paths to be the WebSocket handler
-	mux.HandleFunc("/", handleWebSocket)
+	// Route the other paths to the WebSocket handler, echoing by default
+	routes := serverRoutes(config.Routes)
+	for _, route := range routes {
+		behavior := route.Behavior
+		mux.HandleFunc(route.Path, func(w http.ResponseWriter, r *http.Request) {
+			handleWebSocket(w, r, config, behavior)
+		})
+	}
 
 	log.Printf("WebSocket server listening on %s", config.Addr)
-	log.Printf("Health check endpoint available at http://%s/ping", config.Addr)
+	log.Printf("Health check endpoint available at http://%s%s", config.Addr, healthCheckPath)
+	for _, route := range routes {
+		log.Printf("Route %s: %s", route.Path, route.Behavior)
+	}
 
 	return http.ListenAndServe(config.Addr, mux)
 }
@@ -40,7 +119,25 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	// log.Printf("Health check requested from %s", r.RemoteAddr)
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+// handleWebSocket serves one WebSocket client the way its route says:
+// echo every message, read and drop every message, close straight after
+// the upgrade or refuse the upgrade with 503 and Retry-After
+func handleWebSocket(w http.ResponseWriter, r *http.Request, config Config, behavior string) {
+	if behavior == RouteReject {
+		log.Printf("Rejected %s: route %s rejects upgrades", r.RemoteAddr, r.URL.Path)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Like gateways that require one, reject clients offering none of our subprotocols
+	if len(config.Subprotocols) > 0 && !offersSubprotocol(r, config.Subprotocols) {
+		log.Printf("Rejected %s: offered subprotocols '%s', expected one of %s", r.RemoteAddr,
+			strings.Join(websocket.Subprotocols(r), ", "), strings.Join(config.Subprotocols, ", "))
+		http.Error(w, "Unsupported WebSocket subprotocol", http.StatusBadRequest)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -48,11 +145,25 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Client connected: %s", conn.RemoteAddr())
+	log.Printf("Client connected: %s (%s)", conn.RemoteAddr(), r.URL.RequestURI())
+	if conn.Subprotocol() != "" {
+		log.Printf("Subprotocol: %s", conn.Subprotocol())
+	}
+	if config.Compress && strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		conn.SetCompressionLevel(config.CompressLevel)
+		log.Printf("Compression enabled: %s (level %d)", conn.RemoteAddr(), config.CompressLevel)
+	}
 	if xffHeader := r.Header.Get("X-Forwarded-For"); xffHeader != "" {
 		log.Printf("X-Forwarded-For: %s", xffHeader)
 	}
 
+	if behavior == RouteClose {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Closed by route"))
+		conn.Close()
+		log.Printf("Client disconnected: %s", conn.RemoteAddr())
+		return
+	}
+
 	const (
 		pingPeriod  = 10 * time.Second
 		pongTimeout = 30 * time.Second
@@ -128,10 +239,14 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		mu.Unlock()
 
 		switch messageType {
-		case websocket.TextMessage:
-			// Parse client message
-			var msg Message
-			if err := json.Unmarshal(clientMessage, &msg); err != nil {
+		case websocket.TextMessage, websocket.BinaryMessage:
+			if behavior == RouteSink {
+				continue
+			}
+
+			// Parse client message, JSON in text frames or the binary format
+			msg, err := decodeMessage(messageType, clientMessage)
+			if err != nil {
 				log.Printf("Error parsing message: %v", err)
 				continue
 			}
@@ -143,16 +258,29 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				Timestamp: msg.Timestamp,
 				Content:   msg.Content,
 				MessageID: msg.MessageID,
+				Seq:       msg.Seq,
+			}
+
+			// Bulk transfers only carry the payload one way
+			switch msg.Bulk {
+			case BulkUpload:
+				response.Content = ""
+			case BulkDownload:
+				response.Content = bulkPayload(min(max(msg.Size, 0), maxPayloadSize))
 			}
 
-			// Send response back to client
-			responseJSON, err := json.Marshal(response)
+			// Send response back to client, in the encoding it came in
+			encoding := EncodingJSON
+			if messageType == websocket.BinaryMessage {
+				encoding = EncodingBinary
+			}
+			responseType, responseData, err := encodeMessage(response, encoding)
 			if err != nil {
 				log.Printf("Error marshaling response: %v", err)
 				continue
 			}
 
-			if err := conn.WriteMessage(websocket.TextMessage, responseJSON); err != nil {
+			if err := conn.WriteMessage(responseType, responseData); err != nil {
 				log.Printf("Error sending response: %v", err)
 				break
 			}
@@ -161,3 +289,14 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// offersSubprotocol reports whether the upgrade request offers any of the
+// given subprotocols
+func offersSubprotocol(r *http.Request, subprotocols []string) bool {
+	for _, offered := range websocket.Subprotocols(r) {
+		if slices.Contains(subprotocols, offered) {
+			return true
+		}
+	}
+	return false
+}
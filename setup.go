@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of a connection set up, in the order they happen. The total runs
+// up to the upgrade response, or up to the first echo in churn mode. Through
+// a proxy, DNS and connect time the proxy and the proxy phase is the tunnel
+// to the target.
+const (
+	PhaseDNS       = "dns"
+	PhaseConnect   = "connect"
+	PhaseProxy     = "proxy"
+	PhaseTLS       = "tls"
+	PhaseUpgrade   = "upgrade"
+	PhaseFirstEcho = "first echo"
+	PhaseTotal     = "total"
+)
+
+// setupPhases lists the phases in the order they are reported
+var setupPhases = []string{PhaseDNS, PhaseConnect, PhaseProxy, PhaseTLS, PhaseUpgrade, PhaseFirstEcho, PhaseTotal}
+
+// SetupTiming is how long each phase of one connection set up took.
+// Phases that did not happen, such as TLS on a plain connection, are zero.
+type SetupTiming struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	Proxy     time.Duration
+	TLS       time.Duration
+	Upgrade   time.Duration
+	FirstEcho time.Duration
+	Total     time.Duration
+	// TLSState is the state of the completed TLS handshake, if any
+	TLSState *tls.ConnectionState
+}
+
+// phase returns the duration of the named phase
+func (t SetupTiming) phase(name string) time.Duration {
+	switch name {
+	case PhaseDNS:
+		return t.DNS
+	case PhaseConnect:
+		return t.Connect
+	case PhaseProxy:
+		return t.Proxy
+	case PhaseTLS:
+		return t.TLS
+	case PhaseUpgrade:
+		return t.Upgrade
+	case PhaseFirstEcho:
+		return t.FirstEcho
+	case PhaseTotal:
+		return t.Total
+	}
+	return 0
+}
+
+// setupTrace times the phases of a websocket.Dialer dial through httptrace
+// and setupDialContext
+type setupTrace struct {
+	mu         sync.Mutex
+	start      time.Time
+	dnsStart   time.Time
+	dnsDone    time.Time
+	dialStart  time.Time
+	tcpDone    time.Time
+	proxyStart time.Time
+	proxyDone  time.Time
+	connDone   time.Time
+	tlsStart   time.Time
+	tlsDone    time.Time
+	tlsState   *tls.ConnectionState
+	firstByte  time.Time
+	dialFinish time.Time
+}
+
+// setupTraceKey is the context key setupDialContext finds the trace under
+type setupTraceKey struct{}
+
+// newSetupTrace starts timing a dial and returns the context to dial with
+func newSetupTrace(ctx context.Context) (*setupTrace, context.Context) {
+	t := &setupTrace{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mark(&t.dnsStart)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err == nil {
+				t.mark(&t.dnsDone)
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			t.mark(&t.connDone)
+		},
+		TLSHandshakeStart: func() {
+			t.mark(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mark(&t.tlsDone)
+			if err == nil {
+				t.mu.Lock()
+				t.tlsState = &state
+				t.mu.Unlock()
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+		},
+	}
+	ctx = context.WithValue(ctx, setupTraceKey{}, t)
+	return t, httptrace.WithClientTrace(ctx, trace)
+}
+
+// setupDialContext is the NetDialContext of the client dialers. It marks
+// when the TCP connect of the trace in ctx is done. The dialer reports DNS
+// resolution to the trace's DNSStart and DNSDone hooks, and still races IPv6
+// against IPv4 and shares its timeout between the resolved addresses.
+func setupDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	t, ok := ctx.Value(setupTraceKey{}).(*setupTrace)
+	if !ok {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	t.mark(&t.dialStart)
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mark(&t.tcpDone)
+	return conn, nil
+}
+
+func (t *setupTrace) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	*at = time.Now()
+}
+
+// finish records the end of the dial, which is when the upgrade response was read
+func (t *setupTrace) finish() {
+	t.mark(&t.dialFinish)
+}
+
+// timing returns the durations of the phases that completed
+func (t *setupTrace) timing() SetupTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var timing SetupTiming
+	if !t.dnsDone.IsZero() {
+		timing.DNS = t.dnsDone.Sub(t.dnsStart)
+	}
+	if !t.tcpDone.IsZero() {
+		// An IP address is connected to without resolving it
+		connectStart := t.dnsDone
+		if connectStart.IsZero() {
+			connectStart = t.dialStart
+		}
+		timing.Connect = t.tcpDone.Sub(connectStart)
+	}
+	if !t.proxyDone.IsZero() {
+		timing.Proxy = t.proxyDone.Sub(t.proxyStart)
+	}
+	upgradeStart := t.connDone
+	if t.tlsState != nil {
+		timing.TLS = t.tlsDone.Sub(t.tlsStart)
+		timing.TLSState = t.tlsState
+		upgradeStart = t.tlsDone
+	}
+	// The upgrade is the round trip from the request to the 101 response
+	upgradeDone := t.firstByte
+	if upgradeDone.IsZero() {
+		upgradeDone = t.dialFinish
+	}
+	if !t.dialFinish.IsZero() && !upgradeStart.IsZero() {
+		timing.Upgrade = upgradeDone.Sub(upgradeStart)
+	}
+	timing.Total = time.Since(t.start)
+	return timing
+}
+
+// failedPhase names the phase a failed dial stopped in
+func (t *setupTrace) failedPhase() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case !t.dnsStart.IsZero() && t.dnsDone.IsZero():
+		return PhaseDNS
+	case !t.proxyStart.IsZero() && t.proxyDone.IsZero():
+		return PhaseProxy
+	case t.connDone.IsZero():
+		return PhaseConnect
+	case !t.tlsStart.IsZero() && t.tlsState == nil:
+		return PhaseTLS
+	default:
+		return PhaseUpgrade
+	}
+}
+
+// SetupStats collects connection set up timings and failures.
+// It is safe for concurrent use.
+type SetupStats struct {
+	mu       sync.Mutex
+	attempts int64
+	failures map[string]int64
+	phases   map[string]*Histogram
+
+	// Negotiated TLS parameters of the completed handshakes
+	tlsHandshakes int64
+	tlsResumed    int64
+	tlsVersions   map[string]int64
+	tlsCiphers    map[string]int64
+	tlsALPN       map[string]int64
+}
+
+// NewSetupStats creates empty set up statistics
+func NewSetupStats() *SetupStats {
+	phases := make(map[string]*Histogram, len(setupPhases))
+	for _, name := range setupPhases {
+		phases[name] = NewHistogram()
+	}
+	return &SetupStats{
+		failures:    make(map[string]int64),
+		phases:      phases,
+		tlsVersions: make(map[string]int64),
+		tlsCiphers:  make(map[string]int64),
+		tlsALPN:     make(map[string]int64),
+	}
+}
+
+// Record adds one connection attempt. The phases that completed are added to
+// their distributions, and failedPhase names the phase that failed, if any.
+func (s *SetupStats) Record(timing SetupTiming, failedPhase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts++
+	if failedPhase != "" {
+		s.failures[failedPhase]++
+	}
+	for _, name := range setupPhases {
+		// The total only means something for complete set ups
+		if name == PhaseTotal && failedPhase != "" {
+			continue
+		}
+		if d := timing.phase(name); d > 0 {
+			s.phases[name].Record(d)
+		}
+	}
+
+	if state := timing.TLSState; state != nil {
+		s.tlsHandshakes++
+		if state.DidResume {
+			s.tlsResumed++
+		}
+		s.tlsVersions[tls.VersionName(state.Version)]++
+		s.tlsCiphers[tls.CipherSuiteName(state.CipherSuite)]++
+		alpn := state.NegotiatedProtocol
+		if alpn == "" {
+			alpn = "none"
+		}
+		s.tlsALPN[alpn]++
+	}
+}
+
+// RecordFirstEcho adds the time to the first echo of a connection whose set
+// up was recorded without it
+func (s *SetupStats) RecordFirstEcho(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.phases[PhaseFirstEcho].Record(d)
+}
+
+// PhaseSummary is the distribution of one set up phase
+type PhaseSummary struct {
+	Phase       string
+	Count       int64
+	Min         time.Duration
+	Mean        time.Duration
+	Max         time.Duration
+	Percentiles []PercentileValue
+}
+
+// Percentile returns the value of one of the reported percentiles, or the
+// maximum if that percentile is not reported
+func (p PhaseSummary) Percentile(percentile float64) time.Duration {
+	for _, value := range p.Percentiles {
+		if value.Percentile == percentile {
+			return value.Value
+		}
+	}
+	return p.Max
+}
+
+// newPhaseSummary summarises the distribution of one phase
+func newPhaseSummary(name string, hist *Histogram) PhaseSummary {
+	phase := PhaseSummary{
+		Phase: name,
+		Count: hist.Count(),
+		Min:   hist.Min(),
+		Mean:  hist.Mean(),
+		Max:   hist.Max(),
+	}
+	for _, p := range reportedPercentiles {
+		phase.Percentiles = append(phase.Percentiles, PercentileValue{Percentile: p, Value: hist.Percentile(p)})
+	}
+	return phase
+}
+
+// PhaseFailure counts the attempts that failed in one phase
+type PhaseFailure struct {
+	Phase string
+	Count int64
+}
+
+// TLSCount counts the handshakes that negotiated one value of a TLS parameter
+type TLSCount struct {
+	Value string
+	Count int64
+}
+
+// TLSSummary describes the TLS parameters negotiated by the handshakes.
+// The counts are ordered from the most to the least common.
+type TLSSummary struct {
+	Handshakes   int64
+	Resumed      int64
+	Versions     []TLSCount
+	CipherSuites []TLSCount
+	ALPN         []TLSCount
+}
+
+// SetupSummary is a snapshot of the connection set up statistics
+type SetupSummary struct {
+	Attempts int64
+	Failures int64
+	Failed   []PhaseFailure
+	Phases   []PhaseSummary
+	// TLS is nil if no TLS handshake completed
+	TLS *TLSSummary
+}
+
+// FailurePercent returns the percentage of attempts that failed
+func (s SetupSummary) FailurePercent() float64 {
+	if s.Attempts == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Attempts) * 100
+}
+
+// Summary returns a snapshot of the statistics collected so far
+func (s *SetupStats) Summary() *SetupSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := &SetupSummary{Attempts: s.attempts}
+	for _, name := range setupPhases {
+		if count := s.failures[name]; count > 0 {
+			summary.Failures += count
+			summary.Failed = append(summary.Failed, PhaseFailure{Phase: name, Count: count})
+		}
+
+		if hist := s.phases[name]; hist.Count() > 0 {
+			summary.Phases = append(summary.Phases, newPhaseSummary(name, hist))
+		}
+	}
+
+	if s.tlsHandshakes > 0 {
+		summary.TLS = &TLSSummary{
+			Handshakes:   s.tlsHandshakes,
+			Resumed:      s.tlsResumed,
+			Versions:     sortTLSCounts(s.tlsVersions),
+			CipherSuites: sortTLSCounts(s.tlsCiphers),
+			ALPN:         sortTLSCounts(s.tlsALPN),
+		}
+	}
+	return summary
+}
+
+// sortTLSCounts orders counts from the most to the least common
+func sortTLSCounts(counts map[string]int64) []TLSCount {
+	sorted := make([]TLSCount, 0, len(counts))
+	for value, count := range counts {
+		sorted = append(sorted, TLSCount{Value: value, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+// formatTLSCounts lists counts as "value = count"
+func formatTLSCounts(counts []TLSCount) string {
+	parts := make([]string, 0, len(counts))
+	for _, c := range counts {
+		parts = append(parts, fmt.Sprintf("%s = %d", c.Value, c.Count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// printSetupSummary writes the connection set up statistics, of the named
+// target if target is not empty
+func printSetupSummary(w io.Writer, target string, setup *SetupSummary) {
+	if target != "" {
+		fmt.Fprintf(w, "\nConnection set up statistics for %s:\n", target)
+	} else {
+		fmt.Fprintf(w, "\nConnection set up statistics:\n")
+	}
+	fmt.Fprintf(w, "    Attempts = %d, Failed = %d (%.1f%% failure rate)\n",
+		setup.Attempts, setup.Failures, setup.FailurePercent())
+	if len(setup.Failed) > 0 {
+		failed := make([]string, 0, len(setup.Failed))
+		for _, f := range setup.Failed {
+			failed = append(failed, fmt.Sprintf("%s = %d", f.Phase, f.Count))
+		}
+		fmt.Fprintf(w, "    Failed during: %s\n", strings.Join(failed, ", "))
+	}
+	if t := setup.TLS; t != nil {
+		fmt.Fprintf(w, "    TLS handshakes = %d, Resumed = %d\n", t.Handshakes, t.Resumed)
+		fmt.Fprintf(w, "    TLS versions: %s\n", formatTLSCounts(t.Versions))
+		fmt.Fprintf(w, "    Cipher suites: %s\n", formatTLSCounts(t.CipherSuites))
+		fmt.Fprintf(w, "    ALPN: %s\n", formatTLSCounts(t.ALPN))
+	}
+	if len(setup.Phases) > 0 {
+		printPhaseTable(w, "Phase", setup.Phases)
+	}
+}
+
+// printPhaseTable writes one row per phase distribution under the given
+// column title
+func printPhaseTable(w io.Writer, title string, phases []PhaseSummary) {
+	fmt.Fprintf(w, "    %-10s %7s %8s %8s %8s %8s %8s %8s  (us)\n",
+		title, "Count", "Min", "Avg", "p50", "p90", "p99", "Max")
+	for _, p := range phases {
+		fmt.Fprintf(w, "    %-10s %7d %8d %8d %8d %8d %8d %8d\n",
+			p.Phase, p.Count,
+			p.Min.Microseconds(),
+			p.Mean.Microseconds(),
+			p.Percentile(50).Microseconds(),
+			p.Percentile(90).Microseconds(),
+			p.Percentile(99).Microseconds(),
+			p.Max.Microseconds(),
+		)
+	}
+}
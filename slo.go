@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Exit codes for breached thresholds. 1 is used for runtime errors and
+// invalid flag values, and 2 for flags that fail to parse, so threshold
+// failures start at 3. A run that fails exits with 1 even if a threshold
+// was breached too.
+const (
+	ExitMinMessages = 3
+	ExitMaxLoss     = 4
+	ExitMaxP99      = 5
+	ExitMaxAvg      = 6
+)
+
+// Thresholds are the service level objectives checked against the final
+// client statistics. Zero durations and counts and a negative loss disable
+// the corresponding check.
+type Thresholds struct {
+	MaxAvg      time.Duration `json:"max_avg_ns,omitempty"`
+	MaxP99      time.Duration `json:"max_p99_ns,omitempty"`
+	MaxLoss     float64       `json:"max_loss_percent"`
+	MinMessages uint64        `json:"min_messages,omitempty"`
+}
+
+// Enabled reports whether any threshold is set
+func (t Thresholds) Enabled() bool {
+	return t.MaxAvg > 0 || t.MaxP99 > 0 || t.MaxLoss >= 0 || t.MinMessages > 0
+}
+
+// ThresholdCheck is the outcome of a single threshold
+type ThresholdCheck struct {
+	Name     string
+	Actual   string
+	Limit    string
+	Passed   bool
+	ExitCode int
+}
+
+// Evaluate checks the summary against every enabled threshold, in order of
+// precedence for the exit code
+func (t Thresholds) Evaluate(summary Summary) []ThresholdCheck {
+	var checks []ThresholdCheck
+
+	if t.MinMessages > 0 {
+		checks = append(checks, ThresholdCheck{
+			Name:     "messages received",
+			Actual:   fmt.Sprintf("%d", summary.Count),
+			Limit:    fmt.Sprintf(">= %d", t.MinMessages),
+			Passed:   summary.Count >= int64(t.MinMessages),
+			ExitCode: ExitMinMessages,
+		})
+	}
+	if t.MaxLoss >= 0 {
+		checks = append(checks, ThresholdCheck{
+			Name:     "loss",
+			Actual:   fmt.Sprintf("%.2f%%", summary.LossPercent()),
+			Limit:    fmt.Sprintf("<= %.2f%%", t.MaxLoss),
+			Passed:   summary.LossPercent() <= t.MaxLoss,
+			ExitCode: ExitMaxLoss,
+		})
+	}
+	if t.MaxP99 > 0 {
+		p99 := summary.Percentile(99)
+		checks = append(checks, ThresholdCheck{
+			Name:     "p99 RTT",
+			Actual:   fmt.Sprintf("%dus", p99.Microseconds()),
+			Limit:    fmt.Sprintf("<= %dus", t.MaxP99.Microseconds()),
+			Passed:   summary.Count > 0 && p99 <= t.MaxP99,
+			ExitCode: ExitMaxP99,
+		})
+	}
+	if t.MaxAvg > 0 {
+		checks = append(checks, ThresholdCheck{
+			Name:     "average RTT",
+			Actual:   fmt.Sprintf("%dus", summary.Mean.Microseconds()),
+			Limit:    fmt.Sprintf("<= %dus", t.MaxAvg.Microseconds()),
+			Passed:   summary.Count > 0 && summary.Mean <= t.MaxAvg,
+			ExitCode: ExitMaxAvg,
+		})
+	}
+
+	return checks
+}
+
+// ThresholdError is returned by the client when a threshold is breached
+type ThresholdError struct {
+	Failed []ThresholdCheck
+}
+
+func (e *ThresholdError) Error() string {
+	return fmt.Sprintf("%d threshold(s) breached, first: %s", len(e.Failed), e.Failed[0].Name)
+}
+
+// ExitCode returns the exit code of the first breached threshold
+func (e *ThresholdError) ExitCode() int {
+	return e.Failed[0].ExitCode
+}
+
+// checkThresholds prints the verdict for the summary and returns a
+// *ThresholdError if any threshold is breached
+func checkThresholds(w io.Writer, thresholds Thresholds, summary Summary) error {
+	checks := thresholds.Evaluate(summary)
+
+	var failed []ThresholdCheck
+	fmt.Fprintf(w, "\nThreshold checks:\n")
+	for _, check := range checks {
+		result := "ok"
+		if !check.Passed {
+			result = "FAILED"
+			failed = append(failed, check)
+		}
+		fmt.Fprintf(w, "    %-18s %12s  (limit %s)  %s\n", check.Name, check.Actual, check.Limit, result)
+	}
+
+	if len(failed) > 0 {
+		fmt.Fprintf(w, "Verdict: FAIL\n")
+		return &ThresholdError{Failed: failed}
+	}
+	fmt.Fprintf(w, "Verdict: PASS\n")
+	return nil
+}
@@ -85,7 +85,9 @@ func (sf *Snowflake) NextID() (int64, error) {
 
 	sf.lastTimestamp = timestamp
 
-	// Combine the components into a single 64-bit ID
+	// Combine the components into a single 64-bit ID. The shift drops the
+	// top bits of the timestamp, so IDs wrap about every 73 minutes and may
+	// be negative.
 	id := (timestamp << sf.timestampShift) | (sf.nodeID << sf.nodeShift) | sf.sequence
 
 	return id, nil
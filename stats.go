@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportedPercentiles are the percentiles shown in every summary
+var reportedPercentiles = []float64{50, 90, 95, 99, 99.9}
+
+// rttAccumulator holds the statistics of one measurement period
+type rttAccumulator struct {
+	hist *Histogram
+
+	// Running mean and sum of squared deviations (Welford's algorithm)
+	mean float64
+	m2   float64
+
+	// RFC 3550 interarrival jitter, in nanoseconds, with the previous RTT
+	// of every connection so interleaved connections do not add jitter
+	jitter  float64
+	lastRTT map[connKey]time.Duration
+
+	// Message accounting, lost includes late
+	sent int64
+	lost int64
+	late int64
+
+	// Sequence anomalies
+	duplicates int64
+	reordered  int64
+	gaps       int64
+	skipped    int64
+}
+
+// connKey identifies a connection across targets, whose connection IDs
+// all start at zero
+type connKey struct {
+	target string
+	connID int
+}
+
+func newRTTAccumulator() *rttAccumulator {
+	return &rttAccumulator{
+		hist:    NewHistogram(),
+		lastRTT: make(map[connKey]time.Duration),
+	}
+}
+
+func (a *rttAccumulator) record(conn connKey, rtt time.Duration) {
+	a.hist.Record(rtt)
+
+	// Update running variance
+	n := float64(a.hist.Count())
+	delta := float64(rtt) - a.mean
+	a.mean += delta / n
+	a.m2 += delta * (float64(rtt) - a.mean)
+
+	// RFC 3550 section 6.4.1: J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16
+	// where D is the difference between consecutive transit times
+	if last, ok := a.lastRTT[conn]; ok {
+		d := math.Abs(float64(rtt - last))
+		a.jitter += (d - a.jitter) / 16
+	}
+	a.lastRTT[conn] = rtt
+}
+
+func (a *rttAccumulator) summary() Summary {
+	summary := Summary{
+		Count:        a.hist.Count(),
+		Min:          a.hist.Min(),
+		Max:          a.hist.Max(),
+		Mean:         a.hist.Mean(),
+		Distribution: a.hist.Distribution(),
+		Jitter:       time.Duration(a.jitter),
+		Sent:         a.sent,
+		Lost:         a.lost,
+		Late:         a.late,
+		Duplicates:   a.duplicates,
+		Reordered:    a.reordered,
+		Gaps:         a.gaps,
+		Skipped:      a.skipped,
+	}
+	if summary.Count > 1 {
+		summary.StdDev = time.Duration(math.Sqrt(a.m2 / float64(summary.Count-1)))
+	}
+	summary.MeanAbsDev = a.hist.MeanAbsDeviation(summary.Mean)
+	for _, p := range reportedPercentiles {
+		summary.Percentiles = append(summary.Percentiles, PercentileValue{
+			Percentile: p,
+			Value:      a.hist.Percentile(p),
+		})
+	}
+	return summary
+}
+
+// reset clears the accumulator, reusing the histogram buckets
+func (a *rttAccumulator) reset() {
+	hist := a.hist
+	hist.Reset()
+	*a = rttAccumulator{
+		hist:    hist,
+		lastRTT: make(map[connKey]time.Duration),
+	}
+}
+
+// RTTStats collects round trip time measurements for a client run,
+// cumulatively and optionally for the current reporting window.
+// Measurements recorded in a child are also recorded in its parent.
+// It is safe for concurrent use.
+type RTTStats struct {
+	mu          sync.Mutex
+	parent      *RTTStats
+	started     time.Time
+	total       *rttAccumulator
+	window      *rttAccumulator
+	windowStart time.Time
+}
+
+// NewRTTStats creates an empty statistics collector
+func NewRTTStats() *RTTStats {
+	return &RTTStats{
+		started: time.Now(),
+		total:   newRTTAccumulator(),
+	}
+}
+
+// NewChild creates statistics for a part of the run, such as a single
+// connection, that are also aggregated into s
+func (s *RTTStats) NewChild() *RTTStats {
+	child := NewRTTStats()
+	child.parent = s
+	return child
+}
+
+// update applies fn to the cumulative statistics, the current window and the parent
+func (s *RTTStats) update(fn func(a *rttAccumulator)) {
+	s.mu.Lock()
+	fn(s.total)
+	if s.window != nil {
+		fn(s.window)
+	}
+	s.mu.Unlock()
+
+	if s.parent != nil {
+		s.parent.update(fn)
+	}
+}
+
+// Record adds a single round trip time measurement of the given connection
+// to a target
+func (s *RTTStats) Record(target string, connID int, rtt time.Duration) {
+	conn := connKey{target: target, connID: connID}
+	s.update(func(a *rttAccumulator) {
+		a.record(conn, rtt)
+	})
+}
+
+// RecordSent counts a message written to the connection
+func (s *RTTStats) RecordSent() {
+	s.update(func(a *rttAccumulator) {
+		a.sent++
+	})
+}
+
+// RecordLost counts messages whose echo did not arrive in time
+func (s *RTTStats) RecordLost(n int) {
+	s.update(func(a *rttAccumulator) {
+		a.lost += int64(n)
+	})
+}
+
+// RecordLate counts an echo that arrived after its message was declared lost
+func (s *RTTStats) RecordLate() {
+	s.update(func(a *rttAccumulator) {
+		a.late++
+	})
+}
+
+// RecordSequence counts a sequence anomaly reported by a SequenceTracker
+func (s *RTTStats) RecordSequence(event sequenceEvent, skipped uint64) {
+	s.update(func(a *rttAccumulator) {
+		switch event {
+		case sequenceDuplicate:
+			a.duplicates++
+		case sequenceReordered:
+			a.reordered++
+		case sequenceGap:
+			a.gaps++
+			a.skipped += int64(skipped)
+		}
+	})
+}
+
+// PercentileValue is a single percentile of the RTT distribution
+type PercentileValue struct {
+	Percentile float64
+	Value      time.Duration
+}
+
+// Summary is a point-in-time view of the collected statistics
+type Summary struct {
+	Sent         int64
+	Lost         int64
+	Late         int64
+	InFlight     int64
+	Duplicates   int64
+	Reordered    int64
+	Gaps         int64
+	Skipped      int64
+	Count        int64
+	Min          time.Duration
+	Max          time.Duration
+	Mean         time.Duration
+	StdDev       time.Duration
+	MeanAbsDev   time.Duration
+	Jitter       time.Duration
+	Percentiles  []PercentileValue
+	Distribution []HistogramBin
+	Connections  []ConnectionSummary
+	Steps        []StepSummary
+	Targets      []TargetSummary
+	Sizes        []SizeSummary
+	Bulk         *BulkSummary
+	Compression  *CompressionSummary
+	Disconnects  []DisconnectEvent
+	Setup        *SetupSummary
+}
+
+// ConnectionSummary is the summary of a single connection of a run
+type ConnectionSummary struct {
+	ConnID    int
+	NodeID    int64
+	LocalAddr string
+	Summary   Summary
+}
+
+// Summary returns a snapshot of the statistics collected so far
+func (s *RTTStats) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.total.summary()
+}
+
+// IntervalReport is the summary of one reporting window. Start and End are
+// offsets from the start of the run.
+type IntervalReport struct {
+	Start   time.Duration
+	End     time.Duration
+	Summary Summary
+}
+
+// EnableWindow starts collecting statistics per reporting window
+func (s *RTTStats) EnableWindow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.window = newRTTAccumulator()
+	s.windowStart = time.Now()
+}
+
+// TakeWindow returns the statistics of the current window and starts a new one.
+// ok is false when windows are disabled.
+func (s *RTTStats) TakeWindow() (report IntervalReport, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.window == nil {
+		return IntervalReport{}, false
+	}
+
+	now := time.Now()
+	report = IntervalReport{
+		Start:   s.windowStart.Sub(s.started),
+		End:     now.Sub(s.started),
+		Summary: s.window.summary(),
+	}
+	s.window.reset()
+	s.windowStart = now
+	return report, true
+}
+
+// LossPercent returns the share of lost messages, ignoring the ones
+// still in flight when the summary was taken
+func (s Summary) LossPercent() float64 {
+	base := s.Sent - s.InFlight
+	if base <= 0 {
+		return 0
+	}
+	return float64(s.Lost) * 100 / float64(base)
+}
+
+// Percentile returns the value of one of the reported percentiles, or the
+// maximum if that percentile is not reported
+func (s Summary) Percentile(p float64) time.Duration {
+	for _, value := range s.Percentiles {
+		if value.Percentile == p {
+			return value.Value
+		}
+	}
+	return s.Max
+}
+
+// printSummary writes the ping-style summary block to w
+func printSummary(w io.Writer, summary Summary) {
+	// Connection set up comes last, even when no message made it through
+	if summary.Setup != nil {
+		defer printSetupSummary(w, "", summary.Setup)
+	}
+
+	if summary.Count == 0 && summary.Sent == 0 {
+		fmt.Fprintln(w, "\nNo messages were exchanged. Exiting...")
+		return
+	}
+
+	fmt.Fprintf(w, "\nMessage statistics:\n")
+	fmt.Fprintf(w, "    Messages: Sent = %d, Received = %d, Lost = %d (%.1f%% loss), Late = %d\n",
+		summary.Sent,
+		summary.Count,
+		summary.Lost,
+		summary.LossPercent(),
+		summary.Late,
+	)
+	fmt.Fprintf(w, "    Sequence: Duplicates = %d, Out of order = %d, Gaps = %d (%d skipped)\n",
+		summary.Duplicates,
+		summary.Reordered,
+		summary.Gaps,
+		summary.Skipped,
+	)
+	if summary.Gaps > 0 && summary.Lost > 0 {
+		fmt.Fprintf(w, "    A message skipped before it timed out counts as both a gap and lost\n")
+	}
+	if summary.InFlight > 0 {
+		fmt.Fprintf(w, "    Still in flight at exit: %d\n", summary.InFlight)
+	}
+
+	if summary.Count == 0 {
+		// Show which targets failed, even if none of them replied
+		if len(summary.Targets) > 1 {
+			printTargetSummaries(w, summary.Targets)
+		}
+		return
+	}
+
+	fmt.Fprintf(w, "\nApproximate round trip times in micro-seconds:\n")
+	fmt.Fprintf(w, "    Minimum = %dus, Maximum = %dus, Average = %dus\n",
+		summary.Min.Microseconds(),
+		summary.Max.Microseconds(),
+		summary.Mean.Microseconds(),
+	)
+
+	percentiles := make([]string, 0, len(summary.Percentiles))
+	for _, p := range summary.Percentiles {
+		percentiles = append(percentiles, fmt.Sprintf("p%s = %dus", formatPercentile(p.Percentile), p.Value.Microseconds()))
+	}
+	fmt.Fprintf(w, "    %s\n", strings.Join(percentiles, ", "))
+	fmt.Fprintf(w, "    Std deviation = %dus, Mean abs deviation = %dus, Jitter (RFC 3550) = %dus\n",
+		summary.StdDev.Microseconds(),
+		summary.MeanAbsDev.Microseconds(),
+		summary.Jitter.Microseconds(),
+	)
+
+	if len(summary.Distribution) > 0 {
+		fmt.Fprintf(w, "Latency distribution:\n")
+		printDistribution(w, summary.Distribution, summary.Count)
+	}
+
+	fmt.Fprintf(w, "Messages count: %d\n", summary.Count)
+
+	if len(summary.Connections) > 0 {
+		printConnectionTable(w, summary.Connections)
+	}
+	if len(summary.Steps) > 0 {
+		printStepTable(w, summary.Steps)
+	}
+	if summary.Bulk != nil {
+		printBulkSummary(w, summary.Bulk)
+	}
+	if summary.Compression != nil {
+		printCompressionSummary(w, summary.Compression)
+	}
+	if len(summary.Sizes) > 0 {
+		printSizeTable(w, summary.Sizes)
+	}
+	if len(summary.Targets) > 0 {
+		printTargetSummaries(w, summary.Targets)
+	}
+	if len(summary.Disconnects) > 0 {
+		printDisconnects(w, summary.Disconnects)
+	}
+}
+
+// printConnectionTable writes one row of statistics per connection
+func printConnectionTable(w io.Writer, connections []ConnectionSummary) {
+	fmt.Fprintf(w, "\nPer-connection statistics (us):\n")
+	fmt.Fprintf(w, "    %4s %4s  %-21s %7s %7s %6s %8s %8s %8s %8s %8s %8s\n",
+		"Conn", "Node", "Local address", "Sent", "Recv", "Loss%",
+		"Min", "Avg", "p50", "p99", "Max", "Jitter")
+	for _, c := range connections {
+		s := c.Summary
+		fmt.Fprintf(w, "    %4d %4d  %-21s %7d %7d %6.1f %8d %8d %8d %8d %8d %8d\n",
+			c.ConnID, c.NodeID, c.LocalAddr,
+			s.Sent, s.Count, s.LossPercent(),
+			s.Min.Microseconds(),
+			s.Mean.Microseconds(),
+			s.Percentile(50).Microseconds(),
+			s.Percentile(99).Microseconds(),
+			s.Max.Microseconds(),
+			s.Jitter.Microseconds(),
+		)
+	}
+}
+
+// formatIntervalLine renders a reporting window as a one line iperf-style summary
+func formatIntervalLine(report IntervalReport) string {
+	summary := report.Summary
+	line := fmt.Sprintf("[%7.1f-%7.1f sec] Sent = %d, Received = %d, Loss = %.1f%%",
+		report.Start.Seconds(),
+		report.End.Seconds(),
+		summary.Sent,
+		summary.Count,
+		summary.LossPercent(),
+	)
+	if summary.Count == 0 {
+		return line
+	}
+
+	p99 := summary.Percentile(99)
+	return line + fmt.Sprintf(", min/avg/p99/max = %d/%d/%d/%dus, Jitter = %dus",
+		summary.Min.Microseconds(),
+		summary.Mean.Microseconds(),
+		p99.Microseconds(),
+		summary.Max.Microseconds(),
+		summary.Jitter.Microseconds(),
+	)
+}
+
+// printDistribution draws the histogram bins as a horizontal bar chart
+func printDistribution(w io.Writer, bins []HistogramBin, total int64) {
+	const barWidth = 40
+
+	var largest int64
+	for _, bin := range bins {
+		if bin.Count > largest {
+			largest = bin.Count
+		}
+	}
+
+	for _, bin := range bins {
+		bar := 0
+		if largest > 0 {
+			bar = int(bin.Count * barWidth / largest)
+		}
+		if bin.Count > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "    %9dus - %9dus | %-*s %d (%.2f%%)\n",
+			bin.Lower.Microseconds(),
+			bin.Upper.Microseconds(),
+			barWidth, strings.Repeat("#", bar),
+			bin.Count,
+			float64(bin.Count)*100/float64(total),
+		)
+	}
+}
+
+// formatPercentile renders 99.9 as "99.9" and 50 as "50"
+func formatPercentile(p float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", p), "0"), ".")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStatsJitterPerConnection(t *testing.T) {
+	stats := NewRTTStats()
+	// Both targets number their connections from zero, and a steady RTT on
+	// each of them has no jitter however the replies interleave
+	for i := 0; i < 10; i++ {
+		stats.Record("a", 0, time.Millisecond)
+		stats.Record("b", 0, 5*time.Millisecond)
+		stats.Record("a", 1, 3*time.Millisecond)
+	}
+	if got := stats.Summary().Jitter; got != 0 {
+		t.Errorf("Jitter = %v, want 0", got)
+	}
+
+	stats.Record("a", 0, 2*time.Millisecond)
+	if got, want := stats.Summary().Jitter, time.Millisecond/16; got != want {
+		t.Errorf("Jitter = %v, want %v", got, want)
+	}
+}
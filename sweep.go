@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// defaultSweepCount is the number of messages sent per size on each
+// connection when a payload sweep is run without -count
+const defaultSweepCount = 100
+
+// SizeSummary is the summary of one payload size of a sweep. Start and End
+// are offsets from the start of the run.
+type SizeSummary struct {
+	Size    int
+	Start   time.Duration
+	End     time.Duration
+	Summary Summary
+}
+
+// Throughput returns the payload bytes echoed back per second over all
+// connections, from the first message of the size to the last, so it counts
+// -c, -window and -rate. It is 0 if no echo came back.
+func (s SizeSummary) Throughput() float64 {
+	elapsed := s.End - s.Start
+	if s.Summary.Count == 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Size) * float64(s.Summary.Count) / elapsed.Seconds()
+}
+
+// parsePayloadSizes parses the -d value: a comma separated list of sizes,
+// each either a single size or a FROM-TO/STEP range, e.g. "16,256,4096"
+// or "1024-16384/1024"
+func parsePayloadSizes(spec string, max int) ([]int, error) {
+	var sizes []int
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		values, err := parseProfileRange(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload size '%s': %v", item, err)
+		}
+		for _, value := range values {
+			if value != math.Trunc(value) || value > float64(max) {
+				return nil, fmt.Errorf("payload size must be a whole number between 0 and %d, got '%s'", max, item)
+			}
+			sizes = append(sizes, int(value))
+		}
+	}
+
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no payload size given")
+	}
+	return sizes, nil
+}
+
+// runSweep sends a fixed number of messages at every payload size in turn,
+// each on fresh connections, and returns the run summary with one entry per
+// size. It stops early when a size fails or the run is interrupted.
+func (r *clientRun) runSweep(stats *RTTStats) (Summary, error) {
+	load := LoadStep{Rate: r.config.Rate, Connections: r.config.Connections}
+
+	var sizes []SizeSummary
+	var runErr error
+	for i, size := range r.config.PayloadSweep {
+		r.logger.Write(fmt.Sprintf("Size %d/%d: %d bytes, %d message(s) per connection",
+			i+1, len(r.config.PayloadSweep), size, r.config.Count))
+
+		r.config.PayloadSize = size
+		sizeStats := stats.NewChild()
+		probes, err := r.dial(load, sizeStats)
+		if err != nil {
+			runErr = err
+			break
+		}
+		r.dashboard.SetState(fmt.Sprintf("size %d/%d: %d bytes", i+1, len(r.config.PayloadSweep), size))
+
+		start := time.Since(r.started)
+		runErr = r.runProbes(probes, 0, stats)
+		result := SizeSummary{
+			Size:    size,
+			Start:   start,
+			End:     time.Since(r.started),
+			Summary: sizeStats.Summary(),
+		}
+		for _, p := range probes {
+			result.Summary.InFlight += int64(p.tracker.Pending())
+		}
+		sizes = append(sizes, result)
+		r.logger.Write(fmt.Sprintf("Size %d/%d (%d bytes): %s", i+1, len(r.config.PayloadSweep), size,
+			formatIntervalLine(IntervalReport{Start: result.Start, End: result.End, Summary: result.Summary})))
+
+		if runErr != nil || r.aborted {
+			break
+		}
+	}
+
+	summary := stats.Summary()
+	summary.Setup = r.setup.Summary()
+	summary.Disconnects = r.Disconnects()
+	for _, size := range sizes {
+		summary.InFlight += size.Summary.InFlight
+	}
+	summary.Sizes = sizes
+	return summary, runErr
+}
+
+// formatThroughput renders a number of bytes per second with a binary unit
+func formatThroughput(bytesPerSecond float64) string {
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	unit := 0
+	for bytesPerSecond >= 1024 && unit < len(units)-1 {
+		bytesPerSecond /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", bytesPerSecond, units[unit])
+}
+
+// printSizeTable writes one row of statistics per payload size
+func printSizeTable(w io.Writer, sizes []SizeSummary) {
+	fmt.Fprintf(w, "\nPer-size statistics (us):\n")
+	fmt.Fprintf(w, "    %8s %7s %7s %6s %8s %8s %8s %8s %8s %8s %13s\n",
+		"Size", "Sent", "Recv", "Loss%",
+		"Min", "Avg", "p50", "p90", "p99", "Max", "Throughput")
+	for _, size := range sizes {
+		s := size.Summary
+		fmt.Fprintf(w, "    %8d %7d %7d %6.1f %8d %8d %8d %8d %8d %8d %13s\n",
+			size.Size, s.Sent, s.Count, s.LossPercent(),
+			s.Min.Microseconds(),
+			s.Mean.Microseconds(),
+			s.Percentile(50).Microseconds(),
+			s.Percentile(90).Microseconds(),
+			s.Percentile(99).Microseconds(),
+			s.Max.Microseconds(),
+			formatThroughput(size.Throughput()),
+		)
+	}
+	fmt.Fprintf(w, "    Throughput is the payload echoed back per second over all connections\n")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePayloadSizes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "32", want: []int{32}},
+		{spec: "0", want: []int{0}},
+		{spec: "16,256,4096", want: []int{16, 256, 4096}},
+		{spec: " 16 , ,256 ", want: []int{16, 256}},
+		{spec: "1024-4096/1024", want: []int{1024, 2048, 3072, 4096}},
+		{spec: "1000-2500/1000", want: []int{1000, 2000}},
+		{spec: "8,1024-3072/1024,65536", want: []int{8, 1024, 2048, 3072, 65536}},
+		{spec: "100000", want: []int{100000}},
+		{spec: "", wantErr: true},
+		{spec: ",", wantErr: true},
+		{spec: "abc", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "1.5", wantErr: true},
+		{spec: "NaN", wantErr: true},
+		{spec: "100001", wantErr: true},
+		{spec: "0-200000/50000", wantErr: true},
+		{spec: "1024-4096", wantErr: true},
+		{spec: "4096-1024/1024", wantErr: true},
+		{spec: "0-10000/1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parsePayloadSizes(tt.spec, 100000)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePayloadSizes(%q) = %v, want error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parsePayloadSizes(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSizeSummaryThroughput(t *testing.T) {
+	tests := []struct {
+		name string
+		size SizeSummary
+		want float64
+	}{
+		{name: "no echoes", size: SizeSummary{Size: 1024, Start: 0, End: time.Second}},
+		{name: "no time", size: SizeSummary{Size: 1024, Start: time.Second, End: time.Second, Summary: Summary{Count: 10}}},
+		{name: "one second", size: SizeSummary{Size: 1024, Start: 0, End: time.Second, Summary: Summary{Count: 100}},
+			want: 102400},
+		// Many connections echo in parallel, so throughput does not depend on the RTT
+		{name: "half a second", size: SizeSummary{Size: 4096, Start: time.Second, End: 1500 * time.Millisecond,
+			Summary: Summary{Count: 1000, Mean: time.Second}}, want: 8192000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.size.Throughput(); got != tt.want {
+				t.Errorf("Throughput = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Target is one WebSocket server probed by the client
+type Target struct {
+	Name               string            `json:"name"`
+	Addr               string            `json:"addr"`
+	Path               string            `json:"path,omitempty"`
+	UseTLS             bool              `json:"use_tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	ServerName         string            `json:"server_name,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+}
+
+// URL returns the WebSocket URL of the target
+func (t Target) URL() string {
+	// Construct WebSocket URL with appropriate scheme
+	scheme := "ws"
+	if t.UseTLS {
+		scheme = "wss"
+	}
+	// An IPv6 zone, as in [fe80::1%eth0], is escaped in URLs
+	return fmt.Sprintf("%s://%s%s", scheme, strings.ReplaceAll(t.Addr, "%", "%25"), t.Path)
+}
+
+// parseTargetURL fills in the address, path and TLS setting of a target
+// given as a ws:// or wss:// URL. The server name and Host header follow
+// from the address. A target given as host:port is returned as it is.
+func parseTargetURL(target Target) (Target, error) {
+	if !strings.Contains(target.Addr, "://") {
+		return target, nil
+	}
+	u, err := url.Parse(target.Addr)
+	if err != nil {
+		return target, fmt.Errorf("invalid target URL '%s': %v", target.Addr, err)
+	}
+	switch u.Scheme {
+	case "ws":
+		target.UseTLS = false
+	case "wss":
+		target.UseTLS = true
+	default:
+		return target, fmt.Errorf("invalid target URL '%s': scheme must be ws or wss", target.Addr)
+	}
+	if u.Host == "" {
+		return target, fmt.Errorf("invalid target URL '%s': missing host", target.Addr)
+	}
+
+	target.Addr = u.Host
+	target.Path = ""
+	if u.Path != "" || u.RawQuery != "" {
+		target.Path = u.RequestURI()
+	}
+	return target, nil
+}
+
+// TargetSummary is the summary of a single target of a run. Err is set if
+// the target failed. A target that could not be connected to is Unreachable,
+// sent nothing and adds nothing to the run's loss.
+type TargetSummary struct {
+	Target      Target
+	Setup       *SetupSummary
+	Summary     Summary
+	Err         error
+	Unreachable bool
+}
+
+// addrFlags is a custom flag type to handle multiple -addr flags
+type addrFlags struct {
+	addrs []string
+	set   bool
+}
+
+// String is the method to format the flag's value
+func (a *addrFlags) String() string {
+	return strings.Join(a.addrs, ", ")
+}
+
+// Set is the method to set the flag value. The first -addr replaces the default.
+func (a *addrFlags) Set(value string) error {
+	if !a.set {
+		a.addrs = nil
+		a.set = true
+	}
+	a.addrs = append(a.addrs, value)
+	return nil
+}
+
+// loadTargetsFile reads one target per line from a targets file. Each line
+// holds an address or ws:// or wss:// URL followed by optional flags, which
+// default to the values in defaults:
+//
+//	eu.example.com:443 -name eu -tls -H 'Authorization: Bearer xyz'
+//	wss://us.example.com/realtime/v2?tenant=x -name us
+//
+// Empty lines and lines starting with # are ignored.
+func loadTargetsFile(path string, defaults Target) ([]Target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open targets file: %v", err)
+	}
+	defer f.Close()
+
+	var targets []Target
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		target, err := parseTargetLine(line, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		targets = append(targets, target)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read targets file: %v", err)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("targets file %s lists no targets", path)
+	}
+	return targets, nil
+}
+
+// parseTargetLine parses a single line of a targets file
+func parseTargetLine(line string, defaults Target) (Target, error) {
+	args, err := splitArgs(line)
+	if err != nil {
+		return Target{}, err
+	}
+	if strings.HasPrefix(args[0], "-") {
+		return Target{}, fmt.Errorf("line must start with the target address")
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	name := fs.String("name", args[0], "")
+	useTLS := fs.Bool("tls", defaults.UseTLS, "")
+	insecureSkipVerify := fs.Bool("k", defaults.InsecureSkipVerify, "")
+	serverName := fs.String("servername", defaults.ServerName, "")
+	var headers headerFlags
+	fs.Var(&headers, "H", "")
+	if err := fs.Parse(args[1:]); err != nil {
+		return Target{}, err
+	}
+	if fs.NArg() > 0 {
+		return Target{}, fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+
+	// Per-target headers are added to, and override, the global ones
+	merged := make(map[string]string, len(defaults.Headers)+len(headers.headers))
+	for name, value := range defaults.Headers {
+		merged[name] = value
+	}
+	for name, value := range headers.headers {
+		for existing := range merged {
+			if strings.EqualFold(existing, name) {
+				delete(merged, existing)
+			}
+		}
+		merged[name] = value
+	}
+
+	return parseTargetURL(Target{
+		Name:               *name,
+		Addr:               args[0],
+		UseTLS:             *useTLS,
+		InsecureSkipVerify: *insecureSkipVerify,
+		ServerName:         *serverName,
+		Headers:            merged,
+	})
+}
+
+// splitArgs splits a line into shell-like words, honouring single and
+// double quotes
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// connLabel prefixes log lines with the target and connection they belong to
+func connLabel(target string, connID int, labelConns bool) string {
+	switch {
+	case target != "" && labelConns:
+		return fmt.Sprintf("[%s conn %d] ", target, connID)
+	case target != "":
+		return fmt.Sprintf("[%s] ", target)
+	case labelConns:
+		return fmt.Sprintf("[conn %d] ", connID)
+	default:
+		return ""
+	}
+}
+
+// printTargetSummaries writes the per-target table and the set up of each
+// target
+func printTargetSummaries(w io.Writer, targets []TargetSummary) {
+	printTargetTable(w, targets)
+	for _, t := range targets {
+		if t.Setup != nil {
+			printSetupSummary(w, t.Target.Name, t.Setup)
+		}
+	}
+}
+
+// printTargetTable writes one row of statistics per target side by side
+func printTargetTable(w io.Writer, targets []TargetSummary) {
+	width := len("Target")
+	for _, t := range targets {
+		if len(t.Target.Name) > width {
+			width = len(t.Target.Name)
+		}
+	}
+
+	fmt.Fprintf(w, "\nPer-target comparison (us):\n")
+	fmt.Fprintf(w, "    %-*s %9s %7s %7s %6s %8s %8s %8s %8s %8s %8s\n",
+		width, "Target", "Handshake", "Sent", "Recv", "Loss%",
+		"Min", "Avg", "p50", "p90", "p99", "Max")
+	for _, t := range targets {
+		s := t.Summary
+		if t.Unreachable {
+			fmt.Fprintf(w, "    %-*s %9s %7d %7d %6s %8s %8s %8s %8s %8s %8s\n",
+				width, t.Target.Name, "failed", 0, 0, "-", "-", "-", "-", "-", "-", "-")
+			continue
+		}
+		handshake := "-"
+		if t.Setup != nil {
+			if t.Setup.Failures > 0 {
+				handshake = "failed"
+			}
+			for _, phase := range t.Setup.Phases {
+				if phase.Phase == PhaseTotal {
+					handshake = fmt.Sprintf("%d", phase.Mean.Microseconds())
+				}
+			}
+		}
+		fmt.Fprintf(w, "    %-*s %9s %7d %7d %6.1f %8d %8d %8d %8d %8d %8d\n",
+			width, t.Target.Name, handshake,
+			s.Sent, s.Count, s.LossPercent(),
+			s.Min.Microseconds(),
+			s.Mean.Microseconds(),
+			s.Percentile(50).Microseconds(),
+			s.Percentile(90).Microseconds(),
+			s.Percentile(99).Microseconds(),
+			s.Max.Microseconds(),
+		)
+	}
+	for _, t := range targets {
+		switch {
+		case t.Unreachable:
+			fmt.Fprintf(w, "    %s unreachable: %v\n", t.Target.Name, t.Err)
+		case t.Err != nil:
+			fmt.Fprintf(w, "    %s failed: %v\n", t.Target.Name, t.Err)
+		}
+	}
+}
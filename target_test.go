@@ -0,0 +1,102 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{line: "", want: nil},
+		{line: "   \t ", want: nil},
+		{line: "-tls -H X-Env:prod", want: []string{"-tls", "-H", "X-Env:prod"}},
+		{line: "  a \t b  ", want: []string{"a", "b"}},
+		{line: `-H "Authorization: Bearer xyz"`, want: []string{"-H", "Authorization: Bearer xyz"}},
+		{line: `-H 'X-Note: a  b'`, want: []string{"-H", "X-Note: a  b"}},
+		{line: `a"b c"d`, want: []string{"ab cd"}},
+		{line: `"" x`, want: []string{"", "x"}},
+		{line: `''`, want: []string{""}},
+		{line: `"it's"`, want: []string{"it's"}},
+		{line: `'say "hi"'`, want: []string{`say "hi"`}},
+		{line: `"a 'b' c" 'd "e" f'`, want: []string{"a 'b' c", `d "e" f`}},
+		{line: `"x"'y'"z"`, want: []string{"xyz"}},
+		{line: `"abc`, wantErr: true},
+		{line: `abc'`, wantErr: true},
+		{line: `"a 'b" c'`, wantErr: true},
+		{line: `'a "b' c"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := splitArgs(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitArgs(%q) = %q, want error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("splitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTargetURL(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantAddr string
+		wantPath string
+		wantTLS  bool
+		wantURL  string
+		wantErr  bool
+	}{
+		{addr: "localhost:8080", wantAddr: "localhost:8080", wantURL: "ws://localhost:8080"},
+		{addr: "ws://localhost:8080", wantAddr: "localhost:8080", wantURL: "ws://localhost:8080"},
+		{addr: "wss://gw.example.com", wantAddr: "gw.example.com", wantTLS: true, wantURL: "wss://gw.example.com"},
+		{addr: "ws://localhost:8080/", wantAddr: "localhost:8080", wantPath: "/", wantURL: "ws://localhost:8080/"},
+		{addr: "wss://gw.example.com/realtime/v2", wantAddr: "gw.example.com", wantPath: "/realtime/v2", wantTLS: true,
+			wantURL: "wss://gw.example.com/realtime/v2"},
+		{addr: "wss://gw.example.com/realtime/v2?tenant=x&token=a%20b", wantAddr: "gw.example.com",
+			wantPath: "/realtime/v2?tenant=x&token=a%20b", wantTLS: true,
+			wantURL: "wss://gw.example.com/realtime/v2?tenant=x&token=a%20b"},
+		{addr: "ws://host:81?tenant=x", wantAddr: "host:81", wantPath: "/?tenant=x", wantURL: "ws://host:81/?tenant=x"},
+		{addr: "ws://host/a%2Fb", wantAddr: "host", wantPath: "/a%2Fb", wantURL: "ws://host/a%2Fb"},
+		{addr: "ws://host/path#fragment", wantAddr: "host", wantPath: "/path", wantURL: "ws://host/path"},
+		{addr: "ws://[::1]:8080/ws", wantAddr: "[::1]:8080", wantPath: "/ws", wantURL: "ws://[::1]:8080/ws"},
+		{addr: "wss://[2001:db8::1]", wantAddr: "[2001:db8::1]", wantTLS: true, wantURL: "wss://[2001:db8::1]"},
+		{addr: "wss://[fe80::1%25eth0]:443/", wantAddr: "[fe80::1%eth0]:443", wantPath: "/", wantTLS: true,
+			wantURL: "wss://[fe80::1%25eth0]:443/"},
+		{addr: "http://localhost:8080", wantErr: true},
+		{addr: "ws:///path", wantErr: true},
+		{addr: "ws://[::1", wantErr: true},
+		{addr: "ws://host:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := parseTargetURL(Target{Name: "t", Addr: tt.addr})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTargetURL(%q) = %+v, want error", tt.addr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Addr != tt.wantAddr || got.Path != tt.wantPath || got.UseTLS != tt.wantTLS {
+				t.Errorf("parseTargetURL(%q) = addr %q, path %q, TLS %v, want %q, %q, %v",
+					tt.addr, got.Addr, got.Path, got.UseTLS, tt.wantAddr, tt.wantPath, tt.wantTLS)
+			}
+			if got.URL() != tt.wantURL {
+				t.Errorf("URL() = %q, want %q", got.URL(), tt.wantURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// replyStatus classifies an echo received from the server
+type replyStatus int
+
+const (
+	// replyOnTime is an echo for a message still waiting for its reply
+	replyOnTime replyStatus = iota
+	// replyLate is an echo for a message that already timed out
+	replyLate
+	// replyUnknown is an echo for a message this client is not tracking
+	replyUnknown
+)
+
+// pendingMessage is a message waiting for its echo
+type pendingMessage struct {
+	Seq      uint64
+	SendTime time.Time
+	// Intended is when the message was scheduled to be sent, which is
+	// later than SendTime only if the sender fell behind its schedule
+	Intended time.Time
+	Deadline time.Time
+}
+
+// OutstandingTracker keeps track of the messages sent but not yet echoed,
+// and gives up on them once the per-message timeout expires.
+// It is safe for concurrent use.
+type OutstandingTracker struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	pending map[string]pendingMessage
+
+	// IDs and sequence numbers that timed out, kept for a while to
+	// recognise late echoes and to keep them out of the sequence gaps
+	expired     map[string]time.Time
+	expiredSeqs map[uint64]time.Time
+}
+
+// lateRetentionFactor controls how long timed out IDs are remembered,
+// as a multiple of the per-message timeout
+const lateRetentionFactor = 10
+
+// NewOutstandingTracker creates a tracker using the given per-message timeout
+func NewOutstandingTracker(timeout time.Duration) *OutstandingTracker {
+	return &OutstandingTracker{
+		timeout:     timeout,
+		pending:     make(map[string]pendingMessage),
+		expired:     make(map[string]time.Time),
+		expiredSeqs: make(map[uint64]time.Time),
+	}
+}
+
+// Add registers a message that was just sent, along with its sequence number
+// and the time it was scheduled to be sent
+func (t *OutstandingTracker) Add(messageID string, seq uint64, sendTime, intended time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[messageID] = pendingMessage{
+		Seq:      seq,
+		SendTime: sendTime,
+		Intended: intended,
+		Deadline: sendTime.Add(t.timeout),
+	}
+}
+
+// Complete marks the message as echoed and reports whether the echo was in time
+func (t *OutstandingTracker) Complete(messageID string) (pendingMessage, replyStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if msg, ok := t.pending[messageID]; ok {
+		delete(t.pending, messageID)
+		return msg, replyOnTime
+	}
+	if _, ok := t.expired[messageID]; ok {
+		// Only count the first late echo of a message
+		delete(t.expired, messageID)
+		return pendingMessage{}, replyLate
+	}
+	return pendingMessage{}, replyUnknown
+}
+
+// Expire gives up on every message whose deadline has passed and returns
+// how many were given up on
+func (t *OutstandingTracker) Expire(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expired := 0
+	for id, msg := range t.pending {
+		if now.After(msg.Deadline) {
+			t.expire(id, msg, now)
+			expired++
+		}
+	}
+
+	// Forget timed out IDs after a while to keep memory bounded
+	retention := t.timeout * lateRetentionFactor
+	for id, at := range t.expired {
+		if now.Sub(at) > retention {
+			delete(t.expired, id)
+		}
+	}
+	for seq, at := range t.expiredSeqs {
+		if now.Sub(at) > retention {
+			delete(t.expiredSeqs, seq)
+		}
+	}
+
+	return expired
+}
+
+// expire moves a pending message to the timed out ones. The caller holds t.mu.
+func (t *OutstandingTracker) expire(id string, msg pendingMessage, now time.Time) {
+	delete(t.pending, id)
+	t.expired[id] = now
+	if msg.Seq != 0 {
+		t.expiredSeqs[msg.Seq] = now
+	}
+}
+
+// ExpiredBetween returns how many of the sequence numbers from first to last
+// timed out recently. Those are already counted as lost.
+func (t *OutstandingTracker) ExpiredBetween(first, last uint64) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var count uint64
+	for seq := range t.expiredSeqs {
+		if seq >= first && seq <= last {
+			count++
+		}
+	}
+	return count
+}
+
+// ExpireAll gives up on every pending message, as when the connection they
+// were sent on is gone, and returns how many were given up on
+func (t *OutstandingTracker) ExpireAll(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expired := len(t.pending)
+	for id, msg := range t.pending {
+		t.expire(id, msg, now)
+	}
+	return expired
+}
+
+// Pending returns the number of messages still waiting for their echo
+func (t *OutstandingTracker) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.pending)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ANSI escape sequences used by the dashboard
+const (
+	ansiAltScreenOn  = "\033[?1049h"
+	ansiAltScreenOff = "\033[?1049l"
+	ansiHideCursor   = "\033[?25l"
+	ansiShowCursor   = "\033[?25h"
+	ansiHome         = "\033[H"
+	ansiClearLine    = "\033[K"
+	ansiClearBelow   = "\033[J"
+)
+
+const (
+	// dashboardRefresh is how often the dashboard is redrawn
+	dashboardRefresh = 250 * time.Millisecond
+	// sparklineLength is the number of recent samples in the sparkline
+	sparklineLength = 60
+	// dashboardLogLines is the number of recent log lines shown
+	dashboardLogLines = 6
+)
+
+// sparkTicks are the bar heights of the sparkline, lowest first
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// ConnectionInfo describes an established WebSocket connection
+type ConnectionInfo struct {
+	URL        string
+	LocalAddr  string
+	RemoteAddr string
+	Handshake  time.Duration
+	TLS        *tls.ConnectionState
+	// Subprotocol is the negotiated subprotocol, if any
+	Subprotocol string
+}
+
+// Dashboard is a live terminal view of a client run that redraws in place.
+// It consumes the same sample stream as the text output and doubles as the
+// log output, keeping the most recent lines on screen.
+// Attach, SetState and SetConnection are safe to call on a nil *Dashboard.
+type Dashboard struct {
+	mu       sync.Mutex
+	out      io.Writer
+	stats    *RTTStats
+	state    string
+	conn     ConnectionInfo
+	started  time.Time
+	current  time.Duration
+	recent   []time.Duration
+	logLines []string
+	partial  bytes.Buffer
+	stopOnce sync.Once
+	stopChan chan struct{}
+	stopped  chan struct{}
+}
+
+// NewDashboard switches the terminal to the alternate screen and starts redrawing
+func NewDashboard(out io.Writer) *Dashboard {
+	d := &Dashboard{
+		out:      out,
+		state:    "connecting",
+		started:  time.Now(),
+		stopChan: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	fmt.Fprint(out, ansiAltScreenOn+ansiHideCursor)
+	go d.refresh()
+
+	return d
+}
+
+// Attach sets the statistics shown by the dashboard
+func (d *Dashboard) Attach(stats *RTTStats) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stats = stats
+}
+
+// SetState updates the connection state line
+func (d *Dashboard) SetState(state string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state = state
+}
+
+// SetConnection shows the details of an established connection
+func (d *Dashboard) SetConnection(info ConnectionInfo) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conn = info
+}
+
+// Write receives the output of the buffered logger
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Once the dashboard is gone, log lines go straight to the terminal
+	select {
+	case <-d.stopChan:
+		return d.out.Write(p)
+	default:
+	}
+
+	d.partial.Write(p)
+	for {
+		line, err := d.partial.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			d.partial.Reset()
+			d.partial.WriteString(line)
+			break
+		}
+		d.logLines = append(d.logLines, strings.TrimRight(line, "\n"))
+	}
+	if len(d.logLines) > dashboardLogLines {
+		d.logLines = d.logLines[len(d.logLines)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// WriteSample feeds a measurement into the sparkline
+func (d *Dashboard) WriteSample(sample Sample) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.current = sample.RTT
+	d.recent = append(d.recent, sample.RTT)
+	if len(d.recent) > sparklineLength {
+		d.recent = d.recent[len(d.recent)-sparklineLength:]
+	}
+}
+
+// WriteInterval is a no-op, the dashboard always shows live values
+func (d *Dashboard) WriteInterval(report IntervalReport) {
+}
+
+// WriteSummary leaves the dashboard and prints the regular summary
+func (d *Dashboard) WriteSummary(summary Summary) {
+	d.stop()
+	printSummary(d.out, summary)
+}
+
+// Close restores the terminal if the summary was never written
+func (d *Dashboard) Close() error {
+	d.stop()
+	return nil
+}
+
+// stop ends the redraw loop and restores the normal screen
+func (d *Dashboard) stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopChan)
+		<-d.stopped
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		fmt.Fprint(d.out, ansiShowCursor+ansiAltScreenOff)
+		// Keep the last log lines visible after leaving the dashboard
+		for _, line := range d.logLines {
+			fmt.Fprintln(d.out, line)
+		}
+	})
+}
+
+// refresh redraws the dashboard until stopped
+func (d *Dashboard) refresh() {
+	defer close(d.stopped)
+
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+
+	for {
+		d.draw()
+		select {
+		case <-ticker.C:
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+// draw renders one frame
+func (d *Dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var summary Summary
+	if d.stats != nil {
+		summary = d.stats.Summary()
+	}
+
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString(ansiClearLine + "\n")
+	}
+
+	b.WriteString(ansiHome)
+	line("%s - %s   (Ctrl+C to stop)", GetUserAgent(), d.conn.URL)
+	line("")
+	line("State:      %s (%s elapsed)", d.state, time.Since(d.started).Truncate(time.Second))
+	if d.conn.RemoteAddr != "" {
+		line("Connection: %s -> %s, handshake %dus", d.conn.LocalAddr, d.conn.RemoteAddr, d.conn.Handshake.Microseconds())
+	}
+	if d.conn.TLS != nil {
+		line("TLS:        %s", formatTLSState(d.conn.TLS))
+	}
+	if d.conn.Subprotocol != "" {
+		line("Protocol:   %s", d.conn.Subprotocol)
+	}
+	line("")
+	line("Current RTT: %dus", d.current.Microseconds())
+	line("Messages:    Sent = %d, Received = %d, Lost = %d (%.1f%% loss), Late = %d",
+		summary.Sent, summary.Count, summary.Lost, summary.LossPercent(), summary.Late)
+	if summary.Count > 0 {
+		line("RTT:         min/avg/p99/max = %d/%d/%d/%dus, Jitter = %dus",
+			summary.Min.Microseconds(),
+			summary.Mean.Microseconds(),
+			summary.Percentile(99).Microseconds(),
+			summary.Max.Microseconds(),
+			summary.Jitter.Microseconds(),
+		)
+	}
+	line("")
+	line("Last %d RTTs: %s", sparklineLength, sparkline(d.recent))
+	line("")
+	if len(summary.Distribution) > 0 {
+		line("Latency distribution:")
+		var hist bytes.Buffer
+		printDistribution(&hist, summary.Distribution, summary.Count)
+		for _, l := range strings.Split(strings.TrimRight(hist.String(), "\n"), "\n") {
+			line("%s", l)
+		}
+		line("")
+	}
+	for _, l := range d.logLines {
+		line("%s", l)
+	}
+	b.WriteString(ansiClearBelow)
+
+	io.WriteString(d.out, b.String())
+}
+
+// sparkline renders the values as a row of bars scaled between their min and max
+func sparkline(values []time.Duration) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	lowest, highest := values[0], values[0]
+	for _, v := range values {
+		if v < lowest {
+			lowest = v
+		}
+		if v > highest {
+			highest = v
+		}
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		tick := 0
+		if highest > lowest {
+			tick = int(int64(v-lowest) * int64(len(sparkTicks)-1) / int64(highest-lowest))
+		}
+		b.WriteRune(sparkTicks[tick])
+	}
+	fmt.Fprintf(&b, "  (%d-%dus)", lowest.Microseconds(), highest.Microseconds())
+	return b.String()
+}
+
+// formatTLSState describes the negotiated TLS parameters in one line
+func formatTLSState(state *tls.ConnectionState) string {
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	resumed := "no"
+	if state.DidResume {
+		resumed = "yes"
+	}
+	return fmt.Sprintf("%s, %s, ALPN %s, resumed %s, server name %s",
+		tls.VersionName(state.Version),
+		tls.CipherSuiteName(state.CipherSuite),
+		alpn,
+		resumed,
+		state.ServerName,
+	)
+}